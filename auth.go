@@ -0,0 +1,270 @@
+package main
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timestampHeader carries the time a signed request was made, in seconds
+// since the epoch
+const timestampHeader = "X-Purge-Timestamp"
+
+// nonceHeader lets a client sign the same request twice within a second
+const nonceHeader = "X-Purge-Nonce"
+
+// signedHeaders are the headers covered by a request signature, those that
+// decide what a purge removes
+var signedHeaders = []string{
+	"X-Purge-Regex",
+	softPurgeHeader,
+	"Xkey",
+	"Surrogate-Key",
+	xkeyPurgeHeader,
+	xkeySoftPurgeHeader,
+	banExpressionHeader,
+	banHostHeader,
+	banURLHeader,
+	nonceHeader,
+}
+
+// clientSecret is a bearer token or signing key of a named client
+type clientSecret struct {
+	name   string
+	secret []byte
+}
+
+// clientAuth holds the credentials purge clients authenticate with
+type clientAuth struct {
+	tokens  []clientSecret
+	keys    map[string][]byte
+	maxSkew time.Duration
+	// seen holds the signatures already accepted
+	seen *replayCache
+}
+
+// replayCache holds the signatures of accepted requests until their
+// timestamps are too old to be accepted anyway, so that a captured request
+// can't be sent again
+type replayCache struct {
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+// signedRequests is kept across reloads, a signature doesn't become any
+// less valid when the configuration changes
+var signedRequests = newReplayCache()
+
+func newReplayCache() *replayCache {
+	return &replayCache{seen: map[string]time.Time{}}
+}
+
+// add records signature until expires, and returns false if it had already
+// been recorded
+func (c *replayCache) add(signature string, expires time.Time) bool {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.pruned) >= time.Second {
+		for s, e := range c.seen {
+			if now.After(e) {
+				delete(c.seen, s)
+			}
+		}
+		c.pruned = now
+	}
+	if e, ok := c.seen[signature]; ok && !now.After(e) {
+		return false
+	}
+	c.seen[signature] = expires
+	return true
+}
+
+// newClientAuth reads the --auth-tokens and --auth-hmac-keys files, and
+// returns nil when neither is set
+func newClientAuth(s settings) (*clientAuth, error) {
+	if s.authTokens == "" && s.authKeys == "" {
+		return nil, nil
+	}
+	a := &clientAuth{keys: map[string][]byte{}, maxSkew: s.authMaxSkew, seen: signedRequests}
+	if s.authTokens != "" {
+		tokens, err := readClientSecrets(s.authTokens)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read auth tokens: %v", err)
+		}
+		a.tokens = tokens
+	}
+	if s.authKeys != "" {
+		keys, err := readClientSecrets(s.authKeys)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read auth HMAC keys: %v", err)
+		}
+		for _, key := range keys {
+			a.keys[key.name] = key.secret
+		}
+	}
+	return a, nil
+}
+
+// readClientSecrets reads a file of "name secret" lines, ignoring blank
+// lines and comments
+func readClientSecrets(path string) ([]clientSecret, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secrets := []clientSecret{}
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a name and a secret", n)
+		}
+		if seen[fields[0]] {
+			return nil, fmt.Errorf("line %d: duplicate client %q", n, fields[0])
+		}
+		seen[fields[0]] = true
+		secrets = append(secrets, clientSecret{name: fields[0], secret: []byte(fields[1])})
+	}
+	return secrets, scanner.Err()
+}
+
+// authenticate returns the name of the client that made r, or the status
+// to refuse it with: 401 without credentials, 403 with wrong ones
+func (a *clientAuth) authenticate(r *http.Request, body []byte) (string, int, error) {
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return "", http.StatusUnauthorized, fmt.Errorf("authentication required")
+	}
+	parts := strings.SplitN(authorization, " ", 2)
+	if len(parts) != 2 {
+		return "", http.StatusUnauthorized, fmt.Errorf("invalid Authorization header")
+	}
+	credentials := strings.TrimSpace(parts[1])
+
+	switch strings.ToLower(parts[0]) {
+	case "bearer":
+		for _, token := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(credentials), token.secret) == 1 {
+				return token.name, 0, nil
+			}
+		}
+		return "", http.StatusForbidden, fmt.Errorf("unknown token")
+	case "hmac":
+		name, signature := credentials, ""
+		if i := strings.LastIndex(credentials, ":"); i >= 0 {
+			name, signature = credentials[:i], credentials[i+1:]
+		}
+		key, ok := a.keys[name]
+		if !ok {
+			return "", http.StatusForbidden, fmt.Errorf("unknown client %q", name)
+		}
+		timestamp := r.Header.Get(timestampHeader)
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return "", http.StatusUnauthorized, fmt.Errorf("signed requests need an %s header", timestampHeader)
+		}
+		signed := time.Unix(seconds, 0)
+		if skew := time.Since(signed); skew > a.maxSkew || skew < -a.maxSkew {
+			return "", http.StatusForbidden, fmt.Errorf("timestamp is more than %v away", a.maxSkew)
+		}
+		expected := signRequest(key, r, timestamp, body)
+		if !hmac.Equal([]byte(signature), []byte(expected)) {
+			return "", http.StatusForbidden, fmt.Errorf("invalid signature")
+		}
+		// Once its timestamp is too old the request is refused anyway
+		if !a.seen.add(name+":"+expected, signed.Add(a.maxSkew)) {
+			return "", http.StatusForbidden, fmt.Errorf("signature already used")
+		}
+		return name, 0, nil
+	}
+	return "", http.StatusUnauthorized, fmt.Errorf("unsupported authorization scheme %q", parts[0])
+}
+
+// signRequest returns the hex HMAC-SHA256 of a request: its method, host,
+// URI, timestamp and signed headers, each on its own line, followed by the
+// hex SHA256 of its body
+func signRequest(key []byte, r *http.Request, timestamp string, body []byte) string {
+	lines := []string{r.Method, r.Host, r.URL.RequestURI(), timestamp}
+	for _, name := range signedHeaders {
+		lines = append(lines, strings.ToLower(name)+":"+strings.Join(r.Header[http.CanonicalHeaderKey(name)], ","))
+	}
+	digest := sha256.Sum256(body)
+	lines = append(lines, hex.EncodeToString(digest[:]))
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkAuth refuses purges from unknown clients when authentication is
+// configured, counting those refused
+func checkAuth(w http.ResponseWriter, r *http.Request, body []byte, state *proxyState) bool {
+	if !authorized(w, r, body, state) {
+		purgesReceived.inc(r.Method, "unauthorized")
+		return false
+	}
+	return true
+}
+
+// authorized refuses requests from unknown clients when authentication is
+// configured, and removes the credentials from requests it accepts so that
+// they are not sent on to varnish
+func authorized(w http.ResponseWriter, r *http.Request, body []byte, state *proxyState) bool {
+	if state.auth == nil {
+		return true
+	}
+	name, status, err := state.auth.authenticate(r, body)
+	if err != nil {
+		log.Printf("Refused %s from %s: %v\n", r.Method, r.RemoteAddr, err)
+		if status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Bearer, HMAC`)
+		}
+		http.Error(w, err.Error(), status)
+		return false
+	}
+	if *debug {
+		log.Printf("%s from client %s\n", r.Method, name)
+	}
+	r.Header = r.Header.Clone()
+	r.Header.Del("Authorization")
+	r.Header.Del(timestampHeader)
+	r.Header.Del(nonceHeader)
+	return true
+}
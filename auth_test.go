@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadClientSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := map[string]struct {
+		data     string
+		expected string
+	}{
+		"valid":     {"# clients\ncms s3cret\n\npublisher  other\n", "cms publisher"},
+		"missing":   {"cms\n", ""},
+		"extra":     {"cms s3cret more\n", ""},
+		"duplicate": {"cms a\ncms b\n", ""},
+	}
+
+	for k, tc := range cases {
+		path := filepath.Join(dir, k)
+		if err := ioutil.WriteFile(path, []byte(tc.data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		secrets, err := readClientSecrets(path)
+		expect(t, k, err != nil, tc.expected == "")
+		names := []string{}
+		for _, s := range secrets {
+			names = append(names, s.name)
+		}
+		expect(t, k, strings.Join(names, " "), tc.expected)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	auth := &clientAuth{
+		tokens:  []clientSecret{{"cms", []byte("s3cret")}},
+		keys:    map[string][]byte{"publisher": []byte("key")},
+		maxSkew: time.Minute,
+		seen:    newReplayCache(),
+	}
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-2*time.Minute).Unix(), 10)
+	signed := func(r *http.Request, timestamp string, body string) string {
+		return "HMAC publisher:" + signRequest([]byte("key"), r, timestamp, []byte(body))
+	}
+
+	cases := map[string]struct {
+		authorization func(r *http.Request) string
+		timestamp     string
+		tamper        bool
+		name          string
+		status        int
+	}{
+		"bearer":      {func(r *http.Request) string { return "Bearer s3cret" }, "", false, "cms", 0},
+		"wrongtoken":  {func(r *http.Request) string { return "Bearer guess" }, "", false, "", 403},
+		"none":        {func(r *http.Request) string { return "" }, "", false, "", 401},
+		"basic":       {func(r *http.Request) string { return "Basic Y21zOnMzY3JldA==" }, "", false, "", 401},
+		"hmac":        {func(r *http.Request) string { return signed(r, now, "body") }, now, false, "publisher", 0},
+		"stale":       {func(r *http.Request) string { return signed(r, stale, "body") }, stale, false, "", 403},
+		"notimestamp": {func(r *http.Request) string { return signed(r, "", "body") }, "", false, "", 401},
+		"wrongbody":   {func(r *http.Request) string { return signed(r, now, "other") }, now, false, "", 403},
+		"tampered":    {func(r *http.Request) string { return signed(r, now, "body") }, now, true, "", 403},
+		"unknown":     {func(r *http.Request) string { return "HMAC cms:abc" }, now, false, "", 403},
+	}
+
+	for k, tc := range cases {
+		r := httptest.NewRequest("PURGE", "http://example.com/", nil)
+		r.Header.Set("X-Purge-Regex", "^/news/")
+		if tc.timestamp != "" {
+			r.Header.Set(timestampHeader, tc.timestamp)
+		}
+		if authorization := tc.authorization(r); authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		if tc.tamper {
+			r.Header.Set("X-Purge-Regex", ".*")
+		}
+		name, status, err := auth.authenticate(r, []byte("body"))
+		expect(t, k, err != nil, tc.status != 0)
+		expect(t, k, name, tc.name)
+		expect(t, k, status, tc.status)
+	}
+
+	// A signed request is only accepted once, the same purge can be sent
+	// again with another nonce
+	r := httptest.NewRequest("PURGE", "http://example.com/", nil)
+	r.Header.Set(timestampHeader, now)
+	r.Header.Set(nonceHeader, "1")
+	r.Header.Set("Authorization", signed(r, now, "body"))
+	_, status, _ := auth.authenticate(r, []byte("body"))
+	expect(t, "first", status, 0)
+	_, status, _ = auth.authenticate(r, []byte("body"))
+	expect(t, "replayed", status, 403)
+	r.Header.Set(nonceHeader, "2")
+	r.Header.Set("Authorization", signed(r, now, "body"))
+	_, status, _ = auth.authenticate(r, []byte("body"))
+	expect(t, "nonce", status, 0)
+}
+
+func TestAuthRequest(t *testing.T) {
+	received := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	state := useBackends(t, settings{}, backendURL.Host)
+	state.auth = &clientAuth{tokens: []clientSecret{{"cms", []byte("s3cret")}}, maxSkew: time.Minute}
+	handler := newServer(state.settings).Handler
+
+	cases := map[string]struct {
+		method        string
+		target        string
+		authorization string
+		status        int
+	}{
+		"purge":         {"PURGE", "/", "Bearer s3cret", 200},
+		"unauthorized":  {"PURGE", "/", "", 401},
+		"forbidden":     {"PURGE", "/", "Bearer guess", 403},
+		"bulk":          {"POST", "/purge/bulk", "Bearer s3cret", 200},
+		"bulkrefused":   {"POST", "/purge/bulk", "", 401},
+		"purges":        {"GET", "/purges", "Bearer s3cret", 404},
+		"purgesrefused": {"GET", "/purges", "", 401},
+		"purgerefused":  {"GET", "/purges/abc", "Bearer guess", 403},
+	}
+
+	for k, tc := range cases {
+		req := httptest.NewRequest(tc.method, tc.target, strings.NewReader("/a\n"))
+		req.Header.Set("X-Purge-Regex", ".*")
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		expect(t, k, w.Code, tc.status)
+		if tc.status == 401 {
+			expect(t, k, w.Header().Get("WWW-Authenticate"), "Bearer, HMAC")
+		}
+		if tc.status != 200 {
+			continue
+		}
+		header := <-received
+		expect(t, k, header.Get("Authorization"), "")
+	}
+}
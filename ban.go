@@ -0,0 +1,170 @@
+package main
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Headers carrying ban criteria to the varnish servers
+const (
+	banExpressionHeader = "X-Ban-Expression"
+	banHostHeader       = "X-Ban-Host"
+	banURLHeader        = "X-Ban-Url"
+)
+
+// headerName matches a valid HTTP header name
+var headerName = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
+// banCriteria is the JSON body of a BAN request, objects matching every
+// given criterion are banned
+type banCriteria struct {
+	// Host must equal the host the object was fetched for
+	Host string `json:"host"`
+	// URLRegex must match the URL the object was fetched for
+	URLRegex string `json:"url_regex"`
+	// ObjHeader maps response header names to regular expressions their
+	// values must match
+	ObjHeader map[string]string `json:"obj_header"`
+}
+
+// parseBanCriteria decodes and validates ban criteria from a request body
+func parseBanCriteria(body []byte) (banCriteria, error) {
+	var c banCriteria
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&c); err != nil {
+		return c, fmt.Errorf("invalid ban criteria: %v", err)
+	}
+	return c, c.validate()
+}
+
+// validate checks that at least one criterion is given and that each can be
+// quoted in a ban expression
+func (c banCriteria) validate() error {
+	if c.Host == "" && c.URLRegex == "" && len(c.ObjHeader) == 0 {
+		return fmt.Errorf("ban needs at least one of host, url_regex or obj_header")
+	}
+	if err := checkBanValue("host", c.Host); err != nil {
+		return err
+	}
+	if strings.ContainsAny(c.Host, " /") {
+		return fmt.Errorf("invalid host %q", c.Host)
+	}
+	if err := checkBanRegex("url_regex", c.URLRegex); err != nil {
+		return err
+	}
+	for name, value := range c.ObjHeader {
+		if !headerName.MatchString(name) {
+			return fmt.Errorf("invalid obj_header name %q", name)
+		}
+		if value == "" {
+			return fmt.Errorf("obj_header %s: empty regular expression", name)
+		}
+		if err := checkBanRegex("obj_header "+name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkBanValue rejects values that cannot be quoted in a ban expression
+func checkBanValue(name, value string) error {
+	for _, r := range value {
+		if r == '"' || r < ' ' || r == 0x7f {
+			return fmt.Errorf("%s must not contain quotes or control characters", name)
+		}
+	}
+	return nil
+}
+
+// checkBanRegex checks that value is a quotable regular expression, if set
+func checkBanRegex(name, value string) error {
+	if value == "" {
+		return nil
+	}
+	if err := checkBanValue(name, value); err != nil {
+		return err
+	}
+	if _, err := regexp.Compile(value); err != nil {
+		return fmt.Errorf("%s: invalid regular expression: %v", name, err)
+	}
+	return nil
+}
+
+// expression returns the varnish ban expression for the criteria. Host and
+// URL are matched against the x-host and x-url object headers, which the VCL
+// copies from the request so that the ban lurker can test them.
+func (c banCriteria) expression() string {
+	conditions := []string{}
+	if c.Host != "" {
+		conditions = append(conditions, fmt.Sprintf(`obj.http.x-host == "%s"`, c.Host))
+	}
+	if c.URLRegex != "" {
+		conditions = append(conditions, fmt.Sprintf(`obj.http.x-url ~ "%s"`, c.URLRegex))
+	}
+	names := []string{}
+	for name := range c.ObjHeader {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		conditions = append(conditions, fmt.Sprintf(`obj.http.%s ~ "%s"`, strings.ToLower(name), c.ObjHeader[name]))
+	}
+	return strings.Join(conditions, " && ")
+}
+
+// headers sets the headers our VCL reads the ban from on h
+func (c banCriteria) headers(h http.Header) {
+	h.Set(banExpressionHeader, c.expression())
+	if c.Host != "" {
+		h.Set(banHostHeader, c.Host)
+	}
+	if c.URLRegex != "" {
+		h.Set(banURLHeader, c.URLRegex)
+	}
+}
+
+// prepareBan checks a BAN request, translating JSON criteria in body into
+// ban headers on r. Requests without a body must already carry an
+// X-Ban-Expression header.
+func prepareBan(r *http.Request, body []byte) error {
+	if len(bytes.TrimSpace(body)) == 0 {
+		if r.Header.Get(banExpressionHeader) == "" {
+			return fmt.Errorf("ban needs JSON criteria or an %s header", banExpressionHeader)
+		}
+		return nil
+	}
+	criteria, err := parseBanCriteria(body)
+	if err != nil {
+		return err
+	}
+	r.Header = r.Header.Clone()
+	r.Header.Del("Content-Type")
+	r.Header.Del("Content-Length")
+	criteria.headers(r.Header)
+	return nil
+}
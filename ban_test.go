@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseBanCriteria(t *testing.T) {
+	cases := map[string]struct {
+		body       string
+		expression string
+		err        string
+	}{
+		"host":        {`{"host": "example.com"}`, `obj.http.x-host == "example.com"`, ""},
+		"url":         {`{"url_regex": "^/news/"}`, `obj.http.x-url ~ "^/news/"`, ""},
+		"all":         {`{"host": "example.com", "url_regex": "\\.css$", "obj_header": {"X-Tags": "product-1", "Content-Type": "^text/"}}`, `obj.http.x-host == "example.com" && obj.http.x-url ~ "\.css$" && obj.http.content-type ~ "^text/" && obj.http.x-tags ~ "product-1"`, ""},
+		"empty":       {`{}`, "", "ban needs at least one of host, url_regex or obj_header"},
+		"unknown":     {`{"hostname": "example.com"}`, "", `invalid ban criteria: json: unknown field "hostname"`},
+		"syntax":      {`{"host": `, "", "invalid ban criteria: unexpected EOF"},
+		"quote":       {`{"url_regex": "\" || obj.status ~ \"."}`, "", "url_regex must not contain quotes or control characters"},
+		"newline":     {`{"host": "example.com\n"}`, "", "host must not contain quotes or control characters"},
+		"badhost":     {`{"host": "example.com/news"}`, "", `invalid host "example.com/news"`},
+		"badregex":    {`{"url_regex": "("}`, "", "url_regex: invalid regular expression: error parsing regexp: missing closing ): `(`"},
+		"headername":  {`{"obj_header": {"X Tags": "a"}}`, "", `invalid obj_header name "X Tags"`},
+		"headerempty": {`{"obj_header": {"X-Tags": ""}}`, "", "obj_header X-Tags: empty regular expression"},
+	}
+
+	for k, tc := range cases {
+		c, err := parseBanCriteria([]byte(tc.body))
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Fatalf("%s: Expected error %q - Got %v", k, tc.err, err)
+			}
+			continue
+		}
+		expect(t, k, err, nil)
+		expect(t, k, c.expression(), tc.expression)
+	}
+}
+
+func TestBanRequest(t *testing.T) {
+	received := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "BAN" {
+			received <- r.Header
+		}
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	useBackends(t, settings{}, backendURL.Host)
+	handler := newServer(loadState().settings).Handler
+
+	cases := map[string]struct {
+		body       string
+		header     string
+		status     int
+		expression string
+		host       string
+	}{
+		"criteria":   {`{"host": "example.com", "url_regex": "^/news/"}`, "", 200, `obj.http.x-host == "example.com" && obj.http.x-url ~ "^/news/"`, "example.com"},
+		"expression": {"", `obj.http.x-url ~ "^/"`, 200, `obj.http.x-url ~ "^/"`, ""},
+		"invalid":    {`{"url_regex": "("}`, "", 400, "", ""},
+		"missing":    {"", "", 400, "", ""},
+	}
+
+	for k, tc := range cases {
+		req := httptest.NewRequest("BAN", "/status", strings.NewReader(tc.body))
+		if tc.header != "" {
+			req.Header.Set(banExpressionHeader, tc.header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		expect(t, k, w.Code, tc.status)
+		if tc.status != 200 {
+			continue
+		}
+		header := <-received
+		expect(t, k, header.Get(banExpressionHeader), tc.expression)
+		expect(t, k, header.Get(banHostHeader), tc.host)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefixes of the lines of a plain text bulk purge that are not URLs
+const (
+	bulkRegexPrefix    = "regex "
+	bulkXkeyPrefix     = "xkey "
+	bulkSoftXkeyPrefix = "xkey-soft "
+)
+
+// maxBulkBody is the longest body accepted with a bulk purge
+const maxBulkBody = 4 * 1024 * 1024
+
+// bulkItem is one purge of a bulk request, of a URL, of URLs matching a
+// regular expression, or of objects tagged with keys
+type bulkItem struct {
+	URL   string   `json:"url,omitempty"`
+	Regex string   `json:"regex,omitempty"`
+	Keys  []string `json:"keys,omitempty"`
+	Soft  bool     `json:"soft,omitempty"`
+	// Host defaults to the host of the URL, or of the bulk request
+	Host string `json:"host,omitempty"`
+}
+
+// bulkResult is the outcome of one item of a bulk purge
+type bulkResult struct {
+	bulkItem
+	Result   string          `json:"result"`
+	Error    string          `json:"error,omitempty"`
+	ID       string          `json:"id,omitempty"`
+	Backends []backendResult `json:"backends,omitempty"`
+}
+
+// bulkReport is the response to a bulk purge
+type bulkReport struct {
+	Result string       `json:"result"`
+	Items  []bulkResult `json:"items"`
+}
+
+// String returns the item as a line of a plain text bulk purge
+func (item bulkItem) String() string {
+	switch {
+	case item.Regex != "":
+		return bulkRegexPrefix + item.Regex
+	case len(item.Keys) > 0 && item.Soft:
+		return bulkSoftXkeyPrefix + strings.Join(item.Keys, " ")
+	case len(item.Keys) > 0:
+		return bulkXkeyPrefix + strings.Join(item.Keys, " ")
+	}
+	return item.URL
+}
+
+// parseBulkItems reads the items of a bulk purge, either a JSON list or
+// lines of URLs, "regex <regex>", "xkey <keys>" or "xkey-soft <keys>"
+func parseBulkItems(body []byte) ([]bulkItem, error) {
+	items := []bulkItem{}
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&items); err != nil {
+			return nil, fmt.Errorf("invalid bulk purge: %v", err)
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			switch {
+			case line == "" || strings.HasPrefix(line, "#"):
+				continue
+			case strings.HasPrefix(line, bulkRegexPrefix):
+				items = append(items, bulkItem{Regex: strings.TrimSpace(strings.TrimPrefix(line, bulkRegexPrefix))})
+			case strings.HasPrefix(line, bulkXkeyPrefix):
+				items = append(items, bulkItem{Keys: splitTags(strings.TrimPrefix(line, bulkXkeyPrefix))})
+			case strings.HasPrefix(line, bulkSoftXkeyPrefix):
+				items = append(items, bulkItem{Keys: splitTags(strings.TrimPrefix(line, bulkSoftXkeyPrefix)), Soft: true})
+			default:
+				items = append(items, bulkItem{URL: line})
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("invalid bulk purge: %v", err)
+		}
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("bulk purge needs at least one URL, regex or key")
+	}
+	return items, nil
+}
+
+// request returns the PURGE the item is sent to each backend as, URLs are
+// purged with a regex matching only themselves
+func (item bulkItem) request(host string) (*http.Request, error) {
+	given := 0
+	for _, set := range []bool{item.URL != "", item.Regex != "", len(item.Keys) > 0} {
+		if set {
+			given++
+		}
+	}
+	if given != 1 {
+		return nil, fmt.Errorf("item needs exactly one of url, regex or keys")
+	}
+	if item.Soft && len(item.Keys) == 0 {
+		return nil, fmt.Errorf("only keys can be soft purged")
+	}
+
+	path := "/"
+	header := http.Header{}
+	switch {
+	case item.URL != "":
+		u, err := url.Parse(item.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid url: %v", err)
+		}
+		if u.Host != "" {
+			host = u.Host
+		}
+		path = u.RequestURI()
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid url %q", item.URL)
+		}
+		header.Set("X-Purge-Regex", "^"+regexp.QuoteMeta(path)+"$")
+	case item.Regex != "":
+		if err := checkBanRegex("regex", item.Regex); err != nil {
+			return nil, err
+		}
+		header.Set("X-Purge-Regex", item.Regex)
+	default:
+		p := tagPurge{Keys: item.Keys, Soft: item.Soft}
+		if err := p.validate(); err != nil {
+			return nil, err
+		}
+		header.Set(p.header(), strings.Join(p.Keys, " "))
+	}
+
+	if item.Host != "" {
+		host = item.Host
+	}
+	if err := checkBanValue("host", host); err != nil {
+		return nil, err
+	}
+	if strings.ContainsAny(host, " /") {
+		return nil, fmt.Errorf("invalid host %q", host)
+	}
+
+	r, err := http.NewRequest("PURGE", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.Header = header
+	r.Host = host
+	return r, nil
+}
+
+// bulkHandler purges every item of a bulk request, sending them one after
+// another to each backend so that connections are reused
+func bulkHandler(w http.ResponseWriter, r *http.Request, state *proxyState) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+	body, ok := readBody(w, r, maxBulkBody)
+	if !ok {
+		return
+	}
+	if !checkAuth(w, r, body, state) {
+		return
+	}
+	items, err := parseBulkItems(body)
+	if err != nil {
+		purgesReceived.inc("PURGE", "invalid")
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	results := make([]bulkResult, len(items))
+	purges := []*http.Request{}
+	sent := []int{}
+	for i, item := range items {
+		results[i].bulkItem = item
+		purge, err := item.request(r.Host)
+		if err != nil {
+			purgesReceived.inc("PURGE", "invalid")
+			results[i].Result = "invalid"
+			results[i].Error = err.Error()
+			continue
+		}
+		purges = append(purges, purge)
+		sent = append(sent, i)
+	}
+
+	if purgeJobs != nil {
+		for n, i := range sent {
+			results[i].Result = statePending
+			if err := queueBulkItem(&results[i], purges[n]); err != nil {
+				log.Printf("Failed to queue purge: %v\n", err)
+				results[i].Result = "failed"
+				results[i].Error = err.Error()
+			}
+		}
+		report, status := newBulkReport(results, state.settings.partialStatus, state.settings.failureStatus)
+		writeBulkReport(w, r, report, status)
+		return
+	}
+
+	// Retries stop once the purge timeout is reached
+	ctx, cancel := context.WithTimeout(r.Context(), state.settings.purgeTimeout)
+	defer cancel()
+
+	backends := fanOutBulk(ctx, purges, registry.backends(), state)
+	for n, i := range sent {
+		report, _ := newPurgeReport(backends[n], state.settings.partialStatus, state.settings.failureStatus)
+		purgesReceived.inc("PURGE", report.Result)
+		results[i].Result = report.Result
+		results[i].Backends = report.Backends
+	}
+	report, status := newBulkReport(results, state.settings.partialStatus, state.settings.failureStatus)
+	writeBulkReport(w, r, report, status)
+}
+
+// queueBulkItem saves the purge of an item to the queue
+func queueBulkItem(result *bulkResult, purge *http.Request) error {
+	job, err := newPurgeJob(purge, nil)
+	if err != nil {
+		return err
+	}
+	if err := purgeJobs.add(job); err != nil {
+		return err
+	}
+	purgesReceived.inc(purge.Method, "queued")
+	result.ID = job.ID
+	return nil
+}
+
+// fanOutBulk sends every purge to each backend in turn, over one session
+// per backend. The results are indexed by purge and then by backend, in
+// the order of privateIPs.
+func fanOutBulk(ctx context.Context, purges []*http.Request, privateIPs []string, state *proxyState) [][]backendResult {
+	log.Printf("Sending %d purges to: %+v", len(purges), privateIPs)
+	results := make([][]backendResult, len(purges))
+	for i := range results {
+		results[i] = make([]backendResult, len(privateIPs))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(privateIPs))
+	for b, ip := range privateIPs {
+		go func(b int, ip string) {
+			defer wg.Done()
+			var session *cliSession
+			if state.settings.transport == "cli" {
+				session = newCLISession(ip, state)
+				defer session.Close()
+			}
+			for i, purge := range purges {
+				req, err := copyRequest(ctx, purge, nil)
+				if err != nil {
+					results[i][b] = backendResult{Backend: state.settings.deliveryAddr(ip), Error: err.Error()}
+					continue
+				}
+				results[i][b] = forward(req, ip, state, purge.URL.String(), session)
+			}
+		}(b, ip)
+	}
+	wg.Wait()
+
+	for _, backends := range results {
+		for _, result := range backends {
+			backendLatency.observe(result.Latency, result.Backend)
+			if result.failed() {
+				backendErrors.inc(result.Backend)
+			}
+		}
+	}
+	return results
+}
+
+// newBulkReport summarises the items and returns the status code to respond
+// with, as for a single purge. Queued items are pending and count as
+// successful.
+func newBulkReport(results []bulkResult, partialStatus int, failureStatus int) (bulkReport, int) {
+	failed, pending, noBackends := 0, 0, 0
+	for _, result := range results {
+		switch result.Result {
+		case "ok":
+		case statePending:
+			pending++
+		case resultNoBackends:
+			noBackends++
+			failed++
+		default:
+			failed++
+		}
+	}
+	report := bulkReport{Items: results}
+	switch {
+	case len(results) == 0 || noBackends == len(results):
+		report.Result = resultNoBackends
+		return report, failureStatus
+	case failed == 0 && pending > 0:
+		report.Result = statePending
+		return report, http.StatusAccepted
+	case failed == 0:
+		report.Result = "ok"
+		return report, http.StatusOK
+	case failed < len(results):
+		report.Result = "partial"
+		return report, partialStatus
+	default:
+		report.Result = "failed"
+		return report, failureStatus
+	}
+}
+
+// writeBulkReport writes the report as JSON, or as plain text when the
+// client prefers it
+func writeBulkReport(w http.ResponseWriter, r *http.Request, report bulkReport, status int) {
+	if prefersText(r.Header.Get("Accept")) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		failed := 0
+		for _, result := range report.Items {
+			line := fmt.Sprintf("%s %s", result.Result, result.bulkItem)
+			if result.ID != "" {
+				line += " " + result.ID
+			}
+			if result.Error != "" {
+				line += " " + result.Error
+			}
+			fmt.Fprintln(w, line)
+			if result.Result != "ok" && result.Result != statePending {
+				failed++
+			}
+			for _, backend := range result.Backends {
+				if backend.failed() {
+					fmt.Fprintf(w, "  %s %s %v %s\n", backend.Backend, statusText(backend.Status), backend.Latency.Round(time.Millisecond), backend.Error)
+				}
+			}
+		}
+		fmt.Fprintf(w, "%s: %d of %d purges failed\n", report.Result, failed, len(report.Items))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseBulkItems(t *testing.T) {
+	cases := map[string]struct {
+		body     string
+		expected []string
+	}{
+		"json":    {`[{"url": "/a"}, {"regex": "^/news/"}, {"keys": ["a", "b"], "soft": true}]`, []string{"/a", "regex ^/news/", "xkey-soft a b"}},
+		"lines":   {"/a\nhttp://example.com/b?c=d\n\n# comment\nregex ^/news/\nxkey a, b\n", []string{"/a", "http://example.com/b?c=d", "regex ^/news/", "xkey a b"}},
+		"unknown": {`[{"path": "/a"}]`, nil},
+		"broken":  {`[{"url": "/a"}`, nil},
+		"empty":   {"\n# nothing\n", nil},
+	}
+
+	for k, tc := range cases {
+		items, err := parseBulkItems([]byte(tc.body))
+		expect(t, k, err != nil, tc.expected == nil)
+		if tc.expected == nil {
+			continue
+		}
+		expect(t, k, len(items), len(tc.expected))
+		for i, item := range items {
+			expect(t, k, item.String(), tc.expected[i])
+		}
+	}
+}
+
+func TestBulkItemRequest(t *testing.T) {
+	cases := map[string]struct {
+		item   bulkItem
+		host   string
+		path   string
+		header string
+		value  string
+	}{
+		"path":     {bulkItem{URL: "/a.css?v=1"}, "example.com", "/a.css?v=1", "X-Purge-Regex", `^/a\.css\?v=1$`},
+		"absolute": {bulkItem{URL: "http://example.org/b"}, "example.org", "/b", "X-Purge-Regex", "^/b$"},
+		"host":     {bulkItem{URL: "http://example.org/b", Host: "example.net"}, "example.net", "/b", "X-Purge-Regex", "^/b$"},
+		"regex":    {bulkItem{Regex: "^/news/"}, "example.com", "/", "X-Purge-Regex", "^/news/"},
+		"keys":     {bulkItem{Keys: []string{"a", "b", "a"}}, "example.com", "/", xkeyPurgeHeader, "a b"},
+		"soft":     {bulkItem{Keys: []string{"a"}, Soft: true}, "example.com", "/", xkeySoftPurgeHeader, "a"},
+		"nothing":  {bulkItem{}, "", "", "", ""},
+		"both":     {bulkItem{URL: "/a", Regex: "^/"}, "", "", "", ""},
+		"softurl":  {bulkItem{URL: "/a", Soft: true}, "", "", "", ""},
+		"relative": {bulkItem{URL: "a"}, "", "", "", ""},
+		"badregex": {bulkItem{Regex: "("}, "", "", "", ""},
+		"badkey":   {bulkItem{Keys: []string{`"a"`}}, "", "", "", ""},
+		"badhost":  {bulkItem{URL: "/a", Host: "a b"}, "", "", "", ""},
+	}
+
+	for k, tc := range cases {
+		r, err := tc.item.request("example.com")
+		expect(t, k, err != nil, tc.host == "")
+		if tc.host == "" {
+			continue
+		}
+		expect(t, k, r.Host, tc.host)
+		expect(t, k, r.URL.String(), tc.path)
+		expect(t, k, r.Header.Get(tc.header), tc.value)
+	}
+}
+
+func TestBulkHandler(t *testing.T) {
+	var mu sync.Mutex
+	connections := 0
+	received := []string{}
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received = append(received, r.Host+" "+r.URL.String()+" "+r.Header.Get("X-Purge-Regex")+r.Header.Get(xkeyPurgeHeader))
+		mu.Unlock()
+		if r.URL.Path == "/unavailable" {
+			w.WriteHeader(503)
+		}
+	}))
+	backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			connections++
+			mu.Unlock()
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	useBackends(t, settings{}, backendURL.Host)
+	handler := newServer(loadState().settings).Handler
+
+	cases := map[string]struct {
+		body     string
+		status   int
+		result   string
+		items    []string
+		received []string
+	}{
+		"lines": {"/a\nregex ^/news/\nxkey a b\n", 200, "ok", []string{"ok", "ok", "ok"}, []string{
+			"example.com /a ^/a$", "example.com / ^/news/", "example.com / a b",
+		}},
+		"json":    {`[{"url": "http://example.org/b"}]`, 200, "ok", []string{"ok"}, []string{"example.org /b ^/b$"}},
+		"partial": {"/a\n/unavailable\nregex (\n", 207, "partial", []string{"ok", "failed", "invalid"}, []string{"example.com /a ^/a$", "example.com /unavailable ^/unavailable$"}},
+		"failed":  {"regex (\n", 500, "failed", []string{"invalid"}, []string{}},
+		"empty":   {"", 400, "", nil, []string{}},
+	}
+
+	for k, tc := range cases {
+		mu.Lock()
+		connections = 0
+		received = []string{}
+		mu.Unlock()
+
+		req := httptest.NewRequest("POST", "http://example.com/purge/bulk", strings.NewReader(tc.body))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		expect(t, k, w.Code, tc.status)
+		mu.Lock()
+		expect(t, k, fmt.Sprint(received), fmt.Sprint(tc.received))
+		expect(t, k, connections <= 1, true)
+		mu.Unlock()
+		if tc.items == nil {
+			continue
+		}
+
+		var report bulkReport
+		if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+			t.Fatalf("%s: %v", k, err)
+		}
+		expect(t, k, report.Result, tc.result)
+		expect(t, k, len(report.Items), len(tc.items))
+		for i, item := range report.Items {
+			expect(t, k, item.Result, tc.items[i])
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/purge/bulk", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	expect(t, "get", w.Code, 405)
+
+	req = httptest.NewRequest("POST", "/purge/bulk", strings.NewReader(strings.Repeat("/a\n", maxBulkBody/3+1)))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	expect(t, "toolarge", w.Code, 413)
+}
+
+func TestBulkReportNoBackends(t *testing.T) {
+	cases := map[string]struct {
+		results []string
+		result  string
+		status  int
+	}{
+		"nobackends": {[]string{resultNoBackends, resultNoBackends}, resultNoBackends, 500},
+		"invalid":    {[]string{resultNoBackends, "invalid"}, "failed", 500},
+		"some":       {[]string{resultNoBackends, "ok"}, "partial", 207},
+	}
+
+	for k, tc := range cases {
+		results := []bulkResult{}
+		for _, result := range tc.results {
+			results = append(results, bulkResult{Result: result})
+		}
+		report, status := newBulkReport(results, 207, 500)
+		expect(t, k, report.Result, tc.result)
+		expect(t, k, status, tc.status)
+	}
+}
+
+func TestBulkHandlerCLI(t *testing.T) {
+	cli := newFakeCLI(t, "secret\n")
+	defer cli.listener.Close()
+	_, port, _ := net.SplitHostPort(cli.listener.Addr().String())
+	var cliPort int
+	fmt.Sscan(port, &cliPort)
+
+	state := useBackends(t, settings{transport: "cli", cliPort: cliPort, timeout: time.Second}, "127.0.0.1:6081")
+	state.cliSecret = []byte("secret\n")
+
+	req := httptest.NewRequest("POST", "http://example.com/purge/bulk", strings.NewReader("/a\n/b\nxkey c\n"))
+	w := httptest.NewRecorder()
+	bulkHandler(w, req, loadState())
+	expect(t, "status", w.Code, 200)
+	expect(t, "commands", strings.Join(cli.received(), "\n"), strings.Join([]string{
+		`ban "req.http.host" "==" "example.com" "&&" "req.url" "~" "^/a$"`,
+		`ban "req.http.host" "==" "example.com" "&&" "req.url" "~" "^/b$"`,
+		`ban "obj.http.xkey" "~" "(^|[ ,])(c)($|[ ,])"`,
+	}, "\n"))
+	cli.mu.Lock()
+	expect(t, "connections", cli.connections, 1)
+	cli.mu.Unlock()
+}
@@ -0,0 +1,278 @@
+package main
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Varnish CLI status codes
+const (
+	cliStatusOK   = 200
+	cliStatusAuth = 107
+)
+
+// cliConn is an authenticated connection to a varnish management port
+type cliConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialCLI connects to the varnish CLI at addr, answering the authentication
+// challenge with secret if varnish asks for one. The connection must be
+// used before ctx ends or timeout passes.
+func dialCLI(ctx context.Context, addr string, secret []byte, timeout time.Duration) (*cliConn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &cliConn{conn: conn, reader: bufio.NewReader(conn)}
+	c.extend(ctx, timeout)
+	status, banner, err := c.read()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if status == cliStatusAuth {
+		if len(secret) == 0 {
+			conn.Close()
+			return nil, fmt.Errorf("varnish CLI requires authentication, set --cli-secret")
+		}
+		challenge := strings.SplitN(banner, "\n", 2)[0]
+		status, banner, err = c.command("auth " + cliAuthResponse(challenge, secret))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if status != cliStatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("varnish CLI authentication failed with status %d: %s", status, strings.TrimSpace(banner))
+	}
+	return c, nil
+}
+
+// cliAuthResponse returns the answer to an authentication challenge, the
+// SHA256 of the challenge and secret file contents
+func cliAuthResponse(challenge string, secret []byte) string {
+	h := sha256.New()
+	io.WriteString(h, challenge+"\n")
+	h.Write(secret)
+	io.WriteString(h, challenge+"\n")
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// read reads a response, a "status length" line followed by length bytes
+// of body and a newline
+func (c *cliConn) read() (int, string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return 0, "", err
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return 0, "", fmt.Errorf("invalid varnish CLI response %q", line)
+	}
+	status, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid varnish CLI status %q", fields[0])
+	}
+	length, err := strconv.Atoi(fields[1])
+	if err != nil || length < 0 {
+		return 0, "", fmt.Errorf("invalid varnish CLI length %q", fields[1])
+	}
+	body := make([]byte, length+1)
+	if _, err := io.ReadFull(c.reader, body); err != nil {
+		return 0, "", err
+	}
+	return status, string(body[:length]), nil
+}
+
+// command sends a command line and returns the response
+func (c *cliConn) command(line string) (int, string, error) {
+	if _, err := io.WriteString(c.conn, line+"\n"); err != nil {
+		return 0, "", err
+	}
+	return c.read()
+}
+
+// ban adds a ban from its arguments, each is quoted
+func (c *cliConn) ban(args []string) (int, error) {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = cliQuote(arg)
+	}
+	status, body, err := c.command("ban " + strings.Join(quoted, " "))
+	if err != nil {
+		return 0, err
+	}
+	if status != cliStatusOK {
+		return status, fmt.Errorf("ban failed with status %d: %s", status, strings.TrimSpace(body))
+	}
+	return status, nil
+}
+
+func (c *cliConn) Close() error {
+	return c.conn.Close()
+}
+
+// extend allows the connection to be used until ctx ends or timeout passes
+func (c *cliConn) extend(ctx context.Context, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.conn.SetDeadline(deadline)
+}
+
+// cliQuote quotes an argument for the varnish CLI, which unescapes
+// backslashes and quotes in quoted arguments
+func cliQuote(arg string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(arg) + `"`
+}
+
+// splitBanExpression splits a ban expression, as given to ban() in VCL,
+// into its arguments. Quoted arguments may contain spaces, quotes are
+// removed.
+func splitBanExpression(expression string) ([]string, error) {
+	args := []string{}
+	rest := strings.TrimSpace(expression)
+	for rest != "" {
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote in ban expression %q", expression)
+			}
+			args = append(args, rest[1:end+1])
+			rest = rest[end+2:]
+		} else {
+			end := strings.IndexAny(rest, " \t")
+			if end < 0 {
+				end = len(rest)
+			}
+			args = append(args, rest[:end])
+			rest = rest[end:]
+		}
+		rest = strings.TrimLeft(rest, " \t")
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty ban expression")
+	}
+	return args, nil
+}
+
+// banArgs returns the ban arguments for a request: the X-Ban-Expression of
+// a BAN, a ban of objects with any of the keys of a tag purge in their xkey
+// header, or for a PURGE a ban of URLs matching X-Purge-Regex on its host
+func banArgs(r *http.Request) ([]string, error) {
+	if r.Method == "BAN" {
+		return splitBanExpression(r.Header.Get(banExpressionHeader))
+	}
+	if _, ok := r.Header[xkeySoftPurgeHeader]; ok {
+		return nil, fmt.Errorf("soft purges need the http transport")
+	}
+	if keys := splitTags(r.Header.Get(xkeyPurgeHeader)); len(keys) > 0 {
+		for i, key := range keys {
+			keys[i] = regexp.QuoteMeta(key)
+		}
+		return []string{"obj.http.xkey", "~", "(^|[ ,])(" + strings.Join(keys, "|") + ")($|[ ,])"}, nil
+	}
+	args := []string{}
+	if r.Host != "" {
+		args = append(args, "req.http.host", "==", r.Host, "&&")
+	}
+	return append(args, "req.url", "~", r.Header.Get("X-Purge-Regex")), nil
+}
+
+// cliSession bans over one connection to a varnish CLI, so that several
+// bans to a server need not connect and authenticate again
+type cliSession struct {
+	addr  string
+	state *proxyState
+	conn  *cliConn
+}
+
+func newCLISession(ip string, state *proxyState) *cliSession {
+	return &cliSession{addr: cliAddr(ip, state.settings.cliPort), state: state}
+}
+
+// ban makes one attempt at banning, connecting first if need be
+func (s *cliSession) ban(ctx context.Context, args []string) (int, error) {
+	if s.conn == nil {
+		conn, err := dialCLI(ctx, s.addr, s.state.cliSecret, s.state.settings.timeout)
+		if err != nil {
+			return 0, err
+		}
+		s.conn = conn
+	} else {
+		s.conn.extend(ctx, s.state.settings.timeout)
+	}
+	status, err := s.conn.ban(args)
+	if err != nil && status == 0 {
+		// The connection may be broken, the next ban connects again
+		s.Close()
+	}
+	return status, err
+}
+
+func (s *cliSession) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// cliAddr returns the management address of a backend, on the host of the
+// backend at --cli-port
+func cliAddr(ip string, port int) string {
+	host := ip
+	if h, _, err := net.SplitHostPort(ip); err == nil {
+		host = h
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// forwardBan sends the ban for a purge request over a backend's session
+func forwardBan(r *http.Request, session *cliSession) backendResult {
+	result := backendResult{Backend: session.addr}
+	args, err := banArgs(r)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	deliver(r.Context(), &session.state.settings.retry, &result, func(int) (int, error) {
+		return session.ban(r.Context(), args)
+	})
+	return result
+}
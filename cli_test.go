@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testChallenge = "abcdefghijklmnopqrstuvwxyzabcdef"
+
+// fakeCLI is a varnish management port stand-in, recording the commands it
+// is sent after authentication
+type fakeCLI struct {
+	listener net.Listener
+	secret   string
+
+	mu          sync.Mutex
+	commands    []string
+	connections int
+}
+
+func newFakeCLI(t *testing.T, secret string) *fakeCLI {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeCLI{listener: listener, secret: secret}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.connections++
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeCLI) serve(conn net.Conn) {
+	defer conn.Close()
+	respond := func(status int, body string) {
+		fmt.Fprintf(conn, "%-3d %-8d\n%s\n", status, len(body), body)
+	}
+	reader := bufio.NewReader(conn)
+	if f.secret != "" {
+		respond(cliStatusAuth, testChallenge+"\n\nAuthentication required.\n")
+		line, _ := reader.ReadString('\n')
+		if strings.TrimSpace(line) != "auth "+cliAuthResponse(testChallenge, []byte(f.secret)) {
+			respond(cliStatusAuth, testChallenge+"\n\nAuthentication required.\n")
+			return
+		}
+	}
+	respond(cliStatusOK, "-----------------------------\nVarnish Cache CLI 1.0\n")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSuffix(line, "\n")
+		f.mu.Lock()
+		f.commands = append(f.commands, line)
+		f.mu.Unlock()
+		if strings.Contains(line, "bogus") {
+			respond(106, "Unknown or unbannable field \"bogus\"")
+			continue
+		}
+		respond(cliStatusOK, "")
+	}
+}
+
+func (f *fakeCLI) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.commands...)
+}
+
+func TestCLIAuthResponse(t *testing.T) {
+	expect(t, "auth", cliAuthResponse(testChallenge, []byte("secret\n")), "4612dbda0cbd8dcf32665ded74ada5fb344bbaea6f2e41ad9a99688eab0784f4")
+}
+
+func TestSessionBan(t *testing.T) {
+	cases := map[string]struct {
+		serverSecret string
+		clientSecret string
+		args         []string
+		status       int
+		err          string
+	}{
+		"auth":     {"secret\n", "secret\n", []string{"req.url", "~", "^/"}, 200, ""},
+		"noauth":   {"", "", []string{"req.url", "~", "^/"}, 200, ""},
+		"badauth":  {"secret\n", "wrong\n", []string{"req.url", "~", "^/"}, 0, "varnish CLI authentication failed with status 107"},
+		"nosecret": {"secret\n", "", []string{"req.url", "~", "^/"}, 0, "varnish CLI requires authentication, set --cli-secret"},
+		"refused":  {"", "", []string{"bogus", "~", "^/"}, 106, `ban failed with status 106: Unknown or unbannable field "bogus"`},
+	}
+
+	for k, tc := range cases {
+		cli := newFakeCLI(t, tc.serverSecret)
+		state := &proxyState{settings: settings{timeout: time.Second}, cliSecret: []byte(tc.clientSecret)}
+		session := &cliSession{addr: cli.listener.Addr().String(), state: state}
+		status, err := session.ban(context.Background(), tc.args)
+		session.Close()
+		cli.listener.Close()
+		expect(t, k, status, tc.status)
+		if tc.err == "" {
+			expect(t, k, err, nil)
+			expect(t, k, cli.received()[0], `ban "req.url" "~" "^/"`)
+		} else if err == nil || !strings.HasPrefix(err.Error(), tc.err) {
+			t.Fatalf("%s: Expected error %q - Got %v", k, tc.err, err)
+		}
+	}
+}
+
+func TestSplitBanExpression(t *testing.T) {
+	cases := map[string]struct {
+		expression string
+		expected   []string
+	}{
+		"plain":  {`req.url ~ ^/news/`, []string{"req.url", "~", "^/news/"}},
+		"quoted": {`obj.http.x-host == "example.com" && obj.http.x-url ~ "^/a b\.css$"`, []string{"obj.http.x-host", "==", "example.com", "&&", "obj.http.x-url", "~", `^/a b\.css$`}},
+		"spaces": {"  req.url   ~  \"^/\"  ", []string{"req.url", "~", "^/"}},
+		"open":   {`req.url ~ "^/`, nil},
+		"empty":  {" ", nil},
+	}
+
+	for k, tc := range cases {
+		args, err := splitBanExpression(tc.expression)
+		expect(t, k, err != nil, tc.expected == nil)
+		if tc.expected != nil && !reflect.DeepEqual(args, tc.expected) {
+			t.Fatalf("%s: Expected %q - Got %q", k, tc.expected, args)
+		}
+	}
+}
+
+func TestForwardBan(t *testing.T) {
+	cli := newFakeCLI(t, "secret\n")
+	defer cli.listener.Close()
+	_, port, _ := net.SplitHostPort(cli.listener.Addr().String())
+	var cliPort int
+	fmt.Sscan(port, &cliPort)
+
+	state := &proxyState{
+		settings:  settings{transport: "cli", cliPort: cliPort, destport: 80, timeout: time.Second, retry: retryPolicy{attempts: 1}},
+		cliSecret: []byte("secret\n"),
+	}
+
+	cases := map[string]struct {
+		method   string
+		header   string
+		value    string
+		expected string
+	}{
+		"purge": {"PURGE", "X-Purge-Regex", `^/news/\d+`, `ban "req.http.host" "==" "example.com" "&&" "req.url" "~" "^/news/\\d+"`},
+		"ban":   {"BAN", banExpressionHeader, `obj.http.x-url ~ "^/"`, `ban "obj.http.x-url" "~" "^/"`},
+		"tags":  {"PURGE", xkeyPurgeHeader, "a.b c", `ban "obj.http.xkey" "~" "(^|[ ,])(a\\.b|c)($|[ ,])"`},
+	}
+
+	for k, tc := range cases {
+		r, _ := http.NewRequest(tc.method, "http://example.com/", nil)
+		r.Header.Set(tc.header, tc.value)
+		results := fanOut(context.Background(), r, nil, []string{"127.0.0.1:6081"}, state)
+		expect(t, k, len(results), 1)
+		expect(t, k, results[0].Backend, cli.listener.Addr().String())
+		expect(t, k, results[0].Error, "")
+		commands := cli.received()
+		expect(t, k, commands[len(commands)-1], tc.expected)
+	}
+}
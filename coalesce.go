@@ -0,0 +1,179 @@
+package main
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// coalescedHeaders are the headers that decide what a purge removes, purges
+// differing only in other headers are merged
+var coalescedHeaders = []string{
+	"X-Purge-Regex",
+	xkeyPurgeHeader,
+	xkeySoftPurgeHeader,
+	banExpressionHeader,
+	banHostHeader,
+	banURLHeader,
+}
+
+// coalescer merges identical purges arriving within a window of each other
+// into one fan-out
+type coalescer struct {
+	mu   sync.Mutex
+	keys map[string]*coalescedKey
+	// sendAfter calls f after d, tests replace it to send merged purges
+	// when they choose
+	sendAfter func(d time.Duration, f func())
+	// joined is sent true for each caller waiting for a merged purge, so
+	// that tests can tell when it has joined
+	joined chan<- bool
+}
+
+// coalescedKey is when a purge was last sent for a key, and the merged
+// purge waiting to be sent next, if any
+type coalescedKey struct {
+	sent time.Time
+	next *mergedPurge
+}
+
+// mergedPurge is a fan-out shared by identical purges, cancelled if every
+// caller waiting for it goes away
+type mergedPurge struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	callers int
+	done    chan struct{}
+	results []backendResult
+}
+
+var purgeCoalescer = newCoalescer()
+
+func newCoalescer() *coalescer {
+	return &coalescer{
+		keys: map[string]*coalescedKey{},
+		sendAfter: func(d time.Duration, f func()) {
+			time.AfterFunc(d, f)
+		},
+	}
+}
+
+// purgeKey identifies a purge by its method, host, URL, purge headers and
+// body
+func purgeKey(r *http.Request, body []byte) string {
+	parts := []string{r.Method, r.Host, r.URL.String()}
+	for _, name := range coalescedHeaders {
+		parts = append(parts, strings.Join(r.Header[http.CanonicalHeaderKey(name)], "\n"))
+	}
+	parts = append(parts, string(body))
+	return strings.Join(parts, "\x00")
+}
+
+// do calls purge straight away if no identical purge has been sent within
+// window, otherwise callers are merged into one purge sent a window after
+// the last, which returns its results to each of them. Callers arriving
+// once a purge has been sent wait for the next, as it may already have
+// reached some servers. A merged purge has the deadline of its first
+// caller's ctx, a caller leaving early gets ctx's error.
+func (c *coalescer) do(ctx context.Context, key string, window time.Duration, purge func(context.Context) []backendResult) ([]backendResult, error) {
+	now := time.Now()
+	c.mu.Lock()
+	k, ok := c.keys[key]
+	if !ok || (k.next == nil && now.Sub(k.sent) >= window) {
+		if !ok {
+			k = &coalescedKey{}
+			c.keys[key] = k
+		}
+		k.sent = now
+		c.mu.Unlock()
+		defer c.expire(key, k, window)
+		return purge(ctx), nil
+	}
+
+	p := k.next
+	if p == nil {
+		p = &mergedPurge{done: make(chan struct{})}
+		if deadline, ok := ctx.Deadline(); ok {
+			p.ctx, p.cancel = context.WithDeadline(context.Background(), deadline)
+		} else {
+			p.ctx, p.cancel = context.WithCancel(context.Background())
+		}
+		k.next = p
+		c.sendAfter(k.sent.Add(window).Sub(now), func() {
+			defer close(p.done)
+			defer p.cancel()
+			c.mu.Lock()
+			k.next = nil
+			if p.callers == 0 {
+				// Every caller has gone away, there's no one to send it for
+				c.mu.Unlock()
+				return
+			}
+			k.sent = time.Now()
+			c.mu.Unlock()
+			defer c.expire(key, k, window)
+			p.results = purge(p.ctx)
+		})
+	} else {
+		purgesCoalesced.inc()
+	}
+	p.callers++
+	c.mu.Unlock()
+	if c.joined != nil {
+		c.joined <- true
+	}
+
+	select {
+	case <-p.done:
+		return p.results, nil
+	case <-ctx.Done():
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		// The merged purge has the same or an earlier deadline, so its
+		// results are about to arrive
+		<-p.done
+		return p.results, nil
+	}
+	c.mu.Lock()
+	p.callers--
+	if p.callers == 0 {
+		p.cancel()
+	}
+	c.mu.Unlock()
+	return nil, ctx.Err()
+}
+
+// expire forgets key once window has passed without another purge
+func (c *coalescer) expire(key string, k *coalescedKey, window time.Duration) {
+	c.mu.Lock()
+	sent := k.sent
+	c.mu.Unlock()
+	time.AfterFunc(window, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.keys[key] == k && k.next == nil && k.sent.Equal(sent) {
+			delete(c.keys, key)
+		}
+	})
+}
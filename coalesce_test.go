@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPurgeKey(t *testing.T) {
+	purge := func(method string, target string, headers map[string]string, body string) string {
+		r := httptest.NewRequest(method, target, nil)
+		for name, value := range headers {
+			r.Header.Set(name, value)
+		}
+		return purgeKey(r, []byte(body))
+	}
+	base := purge("PURGE", "http://example.com/", map[string]string{"X-Purge-Regex": "^/news/"}, "")
+
+	cases := map[string]struct {
+		key      string
+		expected bool
+	}{
+		"same":        {purge("PURGE", "http://example.com/", map[string]string{"X-Purge-Regex": "^/news/"}, ""), true},
+		"otherheader": {purge("PURGE", "http://example.com/", map[string]string{"X-Purge-Regex": "^/news/", "User-Agent": "cms"}, ""), true},
+		"regex":       {purge("PURGE", "http://example.com/", map[string]string{"X-Purge-Regex": "^/feeds/"}, ""), false},
+		"host":        {purge("PURGE", "http://example.org/", map[string]string{"X-Purge-Regex": "^/news/"}, ""), false},
+		"url":         {purge("PURGE", "http://example.com/news/", map[string]string{"X-Purge-Regex": "^/news/"}, ""), false},
+		"method":      {purge("BAN", "http://example.com/", map[string]string{"X-Purge-Regex": "^/news/"}, ""), false},
+		"body":        {purge("PURGE", "http://example.com/", map[string]string{"X-Purge-Regex": "^/news/"}, "x"), false},
+		"tags":        {purge("PURGE", "http://example.com/", map[string]string{xkeyPurgeHeader: "a"}, ""), false},
+	}
+
+	for k, tc := range cases {
+		expect(t, k, tc.key == base, tc.expected)
+	}
+}
+
+func TestCoalescer(t *testing.T) {
+	c := newCoalescer()
+	scheduled := make(chan time.Duration, 1)
+	var send func()
+	c.sendAfter = func(d time.Duration, f func()) {
+		send = f
+		scheduled <- d
+	}
+	joined := make(chan bool, 10)
+	c.joined = joined
+	var sends int32
+	purge := func(name string) func(context.Context) []backendResult {
+		return func(ctx context.Context) []backendResult {
+			atomic.AddInt32(&sends, 1)
+			return []backendResult{{Backend: name}}
+		}
+	}
+
+	// Nothing has been sent within the window, so the first purge isn't
+	// held back
+	first, err := c.do(context.Background(), "key", time.Minute, purge("first"))
+	expect(t, "first", err, nil)
+	expect(t, "first", first[0].Backend, "first")
+
+	// Those arriving within the window after it are sent together once the
+	// window is up
+	results := make(chan []backendResult, 10)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			r, _ := c.do(context.Background(), "key", time.Minute, purge(fmt.Sprint("merged", i)))
+			results <- r
+		}(i)
+	}
+	delay := <-scheduled
+	expect(t, "delay", delay > 50*time.Second && delay <= time.Minute, true)
+	for i := 0; i < 10; i++ {
+		<-joined
+	}
+	send()
+	merged := (<-results)[0].Backend
+	for i := 1; i < 10; i++ {
+		expect(t, "merged", (<-results)[0].Backend, merged)
+	}
+	expect(t, "sends", atomic.LoadInt32(&sends), int32(2))
+}
+
+func TestCoalescerCallers(t *testing.T) {
+	c := newCoalescer()
+	sends := make(chan func(), 1)
+	c.sendAfter = func(d time.Duration, f func()) { sends <- f }
+	c.do(context.Background(), "key", time.Minute, func(ctx context.Context) []backendResult { return nil })
+
+	// A merged purge no one is waiting for any more isn't sent
+	ctx, cancel := context.WithCancel(context.Background())
+	left := make(chan error)
+	go func() {
+		_, err := c.do(ctx, "key", time.Minute, func(ctx context.Context) []backendResult {
+			t.Error("left: purge sent")
+			return nil
+		})
+		left <- err
+	}()
+	send := <-sends
+	cancel()
+	expect(t, "left", <-left, context.Canceled)
+	send()
+
+	// The deadline of a merged purge is that of its first caller
+	deadline := time.Now().Add(time.Hour)
+	ctx, cancel = context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	purged := make(chan time.Time, 1)
+	go c.do(ctx, "key", time.Minute, func(ctx context.Context) []backendResult {
+		d, _ := ctx.Deadline()
+		purged <- d
+		return nil
+	})
+	send = <-sends
+	send()
+	expect(t, "deadline", (<-purged).Equal(deadline), true)
+}
+
+func TestCoalescerStartedPurge(t *testing.T) {
+	c := newCoalescer()
+	started := make(chan bool)
+	release := make(chan bool)
+	first := make(chan []backendResult)
+	go func() {
+		results, _ := c.do(context.Background(), "key", time.Millisecond, func(ctx context.Context) []backendResult {
+			started <- true
+			<-release
+			return []backendResult{{Backend: "first"}}
+		})
+		first <- results
+	}()
+	<-started
+
+	// The first purge may already have reached the servers, so this one
+	// must not join it
+	second, _ := c.do(context.Background(), "key", time.Millisecond, func(ctx context.Context) []backendResult {
+		return []backendResult{{Backend: "second"}}
+	})
+	expect(t, "second", second[0].Backend, "second")
+	release <- true
+	expect(t, "first", (<-first)[0].Backend, "first")
+}
+
+func TestCoalescedRequests(t *testing.T) {
+	var mu sync.Mutex
+	received := map[string]int{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received[r.Header.Get("X-Purge-Regex")]++
+		mu.Unlock()
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	useBackends(t, settings{coalesceWindow: time.Second}, backendURL.Host)
+	handler := newServer(loadState().settings).Handler
+
+	var wg sync.WaitGroup
+	statuses := make(chan int, 11)
+	for i := 0; i < 11; i++ {
+		regex := "^/news/"
+		if i == 10 {
+			regex = "^/feeds/"
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("PURGE", "/", nil)
+			req.Header.Set("X-Purge-Regex", regex)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			statuses <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	for status := range statuses {
+		expect(t, "status", status, 200)
+	}
+	// The first is sent straight away, and the rest together after it
+	expect(t, "merged", received["^/news/"], 2)
+	expect(t, "other", received["^/feeds/"], 1)
+}
@@ -0,0 +1,423 @@
+package main
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/alecthomas/kingpin.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// config is the contents of a --config file, settings left out of the file
+// are nil and keep their flag values
+type config struct {
+	Listen    *string         `yaml:"listen" toml:"listen"`
+	Port      *int            `yaml:"port" toml:"port"`
+	Cache     *int            `yaml:"cache" toml:"cache"`
+	Destport  *int            `yaml:"destport" toml:"destport"`
+	Debug     *bool           `yaml:"debug" toml:"debug"`
+	Transport *string         `yaml:"transport" toml:"transport"`
+	Coalesce  *duration       `yaml:"coalesce" toml:"coalesce"`
+	Timeouts  timeoutConfig   `yaml:"timeouts" toml:"timeouts"`
+	Status    statusConfig    `yaml:"status" toml:"status"`
+	Success   successConfig   `yaml:"success" toml:"success"`
+	Retry     retryConfig     `yaml:"retry" toml:"retry"`
+	Queue     queueConfig     `yaml:"queue" toml:"queue"`
+	CLI       cliConfig       `yaml:"cli" toml:"cli"`
+	Auth      authConfig      `yaml:"auth" toml:"auth"`
+	Services  []serviceConfig `yaml:"services" toml:"services"`
+}
+
+type timeoutConfig struct {
+	Backend  *duration `yaml:"backend" toml:"backend"`
+	Read     *duration `yaml:"read" toml:"read"`
+	Write    *duration `yaml:"write" toml:"write"`
+	Shutdown *duration `yaml:"shutdown" toml:"shutdown"`
+	Purge    *duration `yaml:"purge" toml:"purge"`
+	Ready    *duration `yaml:"ready" toml:"ready"`
+}
+
+// statusConfig holds the status codes returned when backends fail
+type statusConfig struct {
+	Partial *int `yaml:"partial" toml:"partial"`
+	Failure *int `yaml:"failure" toml:"failure"`
+}
+
+// successConfig holds the criteria for a varnish response to count as a
+// successful purge
+type successConfig struct {
+	Statuses map[string][]int `yaml:"statuses" toml:"statuses"`
+	Body     *string          `yaml:"body" toml:"body"`
+}
+
+// retryConfig holds the retry policy for failed purges
+type retryConfig struct {
+	Attempts   *int      `yaml:"attempts" toml:"attempts"`
+	Backoff    *duration `yaml:"backoff" toml:"backoff"`
+	MaxBackoff *duration `yaml:"maxbackoff" toml:"maxbackoff"`
+	Jitter     *bool     `yaml:"jitter" toml:"jitter"`
+	Statuses   []int     `yaml:"statuses" toml:"statuses"`
+	Errors     []string  `yaml:"errors" toml:"errors"`
+}
+
+// queueConfig holds the settings of the async purge queue
+type queueConfig struct {
+	Dir        *string   `yaml:"dir" toml:"dir"`
+	Workers    *int      `yaml:"workers" toml:"workers"`
+	Retain     *int      `yaml:"retain" toml:"retain"`
+	Attempts   *int      `yaml:"attempts" toml:"attempts"`
+	Backoff    *duration `yaml:"backoff" toml:"backoff"`
+	MaxBackoff *duration `yaml:"maxbackoff" toml:"maxbackoff"`
+	MaxAge     *duration `yaml:"maxage" toml:"maxage"`
+}
+
+// cliConfig holds the settings of the varnish CLI transport
+type cliConfig struct {
+	Port   *int    `yaml:"port" toml:"port"`
+	Secret *string `yaml:"secret" toml:"secret"`
+}
+
+// authConfig holds the credentials purge clients authenticate with
+type authConfig struct {
+	Tokens  *string   `yaml:"tokens" toml:"tokens"`
+	HMAC    *string   `yaml:"hmac" toml:"hmac"`
+	MaxSkew *duration `yaml:"maxskew" toml:"maxskew"`
+}
+
+// duration is a time.Duration written as a string such as "5s"
+type duration time.Duration
+
+func (d *duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// loadConfig reads a YAML or TOML configuration file, chosen by extension,
+// and checks it for errors
+func loadConfig(filename string) (*config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &config{}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		if err := yaml.UnmarshalStrict(data, c); err != nil {
+			return nil, fmt.Errorf("invalid configuration in %s: %v", filename, err)
+		}
+	case ".toml":
+		meta, err := toml.NewDecoder(bytes.NewReader(data)).Decode(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid configuration in %s: %v", filename, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("invalid configuration in %s: unknown setting %s", filename, undecoded[0])
+		}
+	default:
+		return nil, fmt.Errorf("unable to read %s, configuration files must end in .yaml, .yml or .toml", filename)
+	}
+
+	if problems := c.validate(); len(problems) > 0 {
+		return nil, fmt.Errorf("invalid configuration in %s:\n  %s", filename, strings.Join(problems, "\n  "))
+	}
+	c.setDefaults()
+	return c, nil
+}
+
+// validate returns a description of each problem found in the config
+func (c *config) validate() []string {
+	problems := []string{}
+	checkPort := func(name string, port *int) {
+		if port != nil && (*port < 1 || *port > 65535) {
+			problems = append(problems, fmt.Sprintf("%s must be between 1 and 65535, got %d", name, *port))
+		}
+	}
+	checkPort("port", c.Port)
+	checkPort("destport", c.Destport)
+	checkPort("cli.port", c.CLI.Port)
+	if c.Transport != nil && *c.Transport != "http" && *c.Transport != "cli" {
+		problems = append(problems, fmt.Sprintf("transport must be http or cli, got %q", *c.Transport))
+	}
+	if c.Cache != nil && *c.Cache < 0 {
+		problems = append(problems, fmt.Sprintf("cache must not be negative, got %d", *c.Cache))
+	}
+	checkTimeout := func(name string, d *duration) {
+		if d != nil && *d <= 0 {
+			problems = append(problems, fmt.Sprintf("timeouts.%s must be positive, got %v", name, time.Duration(*d)))
+		}
+	}
+	checkTimeout("backend", c.Timeouts.Backend)
+	checkTimeout("read", c.Timeouts.Read)
+	checkTimeout("write", c.Timeouts.Write)
+	checkTimeout("shutdown", c.Timeouts.Shutdown)
+	checkTimeout("purge", c.Timeouts.Purge)
+	checkStatus := func(name string, status *int) {
+		if status != nil && (*status < 100 || *status > 599) {
+			problems = append(problems, fmt.Sprintf("%s must be between 100 and 599, got %d", name, *status))
+		}
+	}
+	checkStatus("status.partial", c.Status.Partial)
+	checkStatus("status.failure", c.Status.Failure)
+	methods := []string{}
+	for method := range c.Success.Statuses {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		for _, status := range c.Success.Statuses[method] {
+			checkStatus("success.statuses."+method, &status)
+		}
+	}
+	if c.Success.Body != nil {
+		if _, err := regexp.Compile(*c.Success.Body); err != nil {
+			problems = append(problems, fmt.Sprintf("success.body is not a valid regular expression: %v", err))
+		}
+	}
+
+	if c.Timeouts.Ready != nil && *c.Timeouts.Ready < 0 {
+		problems = append(problems, fmt.Sprintf("timeouts.ready must not be negative, got %v", time.Duration(*c.Timeouts.Ready)))
+	}
+	if c.Auth.MaxSkew != nil && *c.Auth.MaxSkew <= 0 {
+		problems = append(problems, fmt.Sprintf("auth.maxskew must be positive, got %v", time.Duration(*c.Auth.MaxSkew)))
+	}
+	if c.Coalesce != nil && *c.Coalesce < 0 {
+		problems = append(problems, fmt.Sprintf("coalesce must not be negative, got %v", time.Duration(*c.Coalesce)))
+	}
+	if c.Retry.Attempts != nil && *c.Retry.Attempts < 1 {
+		problems = append(problems, fmt.Sprintf("retry.attempts must be at least 1, got %d", *c.Retry.Attempts))
+	}
+	for _, d := range []struct {
+		name string
+		d    *duration
+	}{
+		{"retry.backoff", c.Retry.Backoff}, {"retry.maxbackoff", c.Retry.MaxBackoff},
+		{"queue.backoff", c.Queue.Backoff}, {"queue.maxbackoff", c.Queue.MaxBackoff}, {"queue.maxage", c.Queue.MaxAge},
+	} {
+		if d.d != nil && *d.d < 0 {
+			problems = append(problems, fmt.Sprintf("%s must not be negative, got %v", d.name, time.Duration(*d.d)))
+		}
+	}
+	for i := range c.Retry.Statuses {
+		checkStatus("retry.statuses", &c.Retry.Statuses[i])
+	}
+	if c.Queue.Workers != nil && *c.Queue.Workers < 1 {
+		problems = append(problems, fmt.Sprintf("queue.workers must be at least 1, got %d", *c.Queue.Workers))
+	}
+	if c.Queue.Retain != nil && *c.Queue.Retain < 0 {
+		problems = append(problems, fmt.Sprintf("queue.retain must not be negative, got %d", *c.Queue.Retain))
+	}
+	if c.Queue.Attempts != nil && *c.Queue.Attempts < 1 {
+		problems = append(problems, fmt.Sprintf("queue.attempts must be at least 1, got %d", *c.Queue.Attempts))
+	}
+	for _, class := range c.Retry.Errors {
+		if err := checkErrorClass(class); err != nil {
+			problems = append(problems, fmt.Sprintf("retry.errors: %v", err))
+		}
+	}
+
+	for i := range c.Services {
+		s := &c.Services[i]
+		for _, p := range s.validate() {
+			problems = append(problems, fmt.Sprintf("services[%d] (%s): %s", i, s.Type, p))
+		}
+	}
+	return problems
+}
+
+// setDefaults fills in the optional service settings that have a default on
+// the command line
+func (c *config) setDefaults() {
+	for i := range c.Services {
+		if c.Services[i].Type == "gce" && c.Services[i].NamePrefix == "" {
+			c.Services[i].NamePrefix = "varnish"
+		}
+	}
+}
+
+// validate returns a description of each required setting missing from a
+// service config
+func (s *serviceConfig) validate() []string {
+	var required map[string]bool
+	switch s.Type {
+	case "aws":
+		required = map[string]bool{"tags": len(s.Tags) > 0}
+	case "gce":
+		required = map[string]bool{"credentials": s.Credentials != "", "project": s.Project != "", "region": s.Region != ""}
+	case "azure":
+		required = map[string]bool{"resourcegroup": s.ResourceGroup != ""}
+	case "static":
+		required = map[string]bool{"file": s.File != ""}
+	case "dns":
+		required = map[string]bool{"record": s.Record != ""}
+	case "k8s", "consul":
+		required = map[string]bool{"service": s.Service != ""}
+	case "":
+		return []string{"type is required"}
+	default:
+		return []string{fmt.Sprintf("unknown type %q, expected one of aws, gce, azure, static, dns, k8s or consul", s.Type)}
+	}
+
+	problems := []string{}
+	for _, name := range []string{"tags", "credentials", "project", "region", "resourcegroup", "file", "record", "service"} {
+		if present, ok := required[name]; ok && !present {
+			problems = append(problems, fmt.Sprintf("%s is required", name))
+		}
+	}
+	return problems
+}
+
+// apply copies settings from the config over s, except for flags given on
+// the command line which take precedence
+func (c *config) apply(s *settings, explicit map[string]bool) {
+	if c.Listen != nil && !explicit["listen"] {
+		s.listen = *c.Listen
+	}
+	if c.Port != nil && !explicit["port"] {
+		s.port = *c.Port
+	}
+	if c.Cache != nil && !explicit["cache"] {
+		s.cache = *c.Cache
+	}
+	if c.Destport != nil && !explicit["destport"] {
+		s.destport = *c.Destport
+	}
+	if c.Debug != nil && !explicit["debug"] {
+		s.debug = *c.Debug
+	}
+	if c.Timeouts.Backend != nil && !explicit["timeout"] {
+		s.timeout = time.Duration(*c.Timeouts.Backend)
+	}
+	if c.Timeouts.Read != nil && !explicit["read-timeout"] {
+		s.readTimeout = time.Duration(*c.Timeouts.Read)
+	}
+	if c.Timeouts.Write != nil && !explicit["write-timeout"] {
+		s.writeTimeout = time.Duration(*c.Timeouts.Write)
+	}
+	if c.Timeouts.Shutdown != nil && !explicit["shutdown-timeout"] {
+		s.shutdownTimeout = time.Duration(*c.Timeouts.Shutdown)
+	}
+	if c.Status.Partial != nil && !explicit["partial-status"] {
+		s.partialStatus = *c.Status.Partial
+	}
+	if c.Status.Failure != nil && !explicit["failure-status"] {
+		s.failureStatus = *c.Status.Failure
+	}
+	if c.Success.Statuses != nil && !explicit["accept-status"] {
+		s.acceptStatus = c.Success.Statuses
+	}
+	if c.Success.Body != nil && !explicit["success-body"] {
+		s.successBody = *c.Success.Body
+	}
+	if c.Timeouts.Purge != nil && !explicit["purge-timeout"] {
+		s.purgeTimeout = time.Duration(*c.Timeouts.Purge)
+	}
+	if c.Coalesce != nil && !explicit["coalesce-window"] {
+		s.coalesceWindow = time.Duration(*c.Coalesce)
+	}
+	if c.Timeouts.Ready != nil && !explicit["ready-max-age"] {
+		s.readyMaxAge = time.Duration(*c.Timeouts.Ready)
+	}
+	if c.Retry.Attempts != nil && !explicit["retries"] {
+		s.retry.attempts = *c.Retry.Attempts
+	}
+	if c.Retry.Backoff != nil && !explicit["retry-backoff"] {
+		s.retry.backoff = time.Duration(*c.Retry.Backoff)
+	}
+	if c.Retry.MaxBackoff != nil && !explicit["retry-max-backoff"] {
+		s.retry.maxBackoff = time.Duration(*c.Retry.MaxBackoff)
+	}
+	if c.Retry.Jitter != nil && !explicit["retry-jitter"] {
+		s.retry.jitter = *c.Retry.Jitter
+	}
+	if c.Retry.Statuses != nil && !explicit["retry-status"] {
+		s.retry.statuses = c.Retry.Statuses
+	}
+	if c.Retry.Errors != nil && !explicit["retry-error"] {
+		s.retry.errors = c.Retry.Errors
+	}
+	if c.Queue.Dir != nil && !explicit["queue-dir"] {
+		s.queueDir = *c.Queue.Dir
+	}
+	if c.Queue.Workers != nil && !explicit["queue-workers"] {
+		s.queueWorkers = *c.Queue.Workers
+	}
+	if c.Queue.Retain != nil && !explicit["queue-retain"] {
+		s.queueRetain = *c.Queue.Retain
+	}
+	if c.Queue.Attempts != nil && !explicit["queue-attempts"] {
+		s.queueRetry.attempts = *c.Queue.Attempts
+	}
+	if c.Queue.Backoff != nil && !explicit["queue-backoff"] {
+		s.queueRetry.backoff = time.Duration(*c.Queue.Backoff)
+	}
+	if c.Queue.MaxBackoff != nil && !explicit["queue-max-backoff"] {
+		s.queueRetry.maxBackoff = time.Duration(*c.Queue.MaxBackoff)
+	}
+	if c.Queue.MaxAge != nil && !explicit["queue-max-age"] {
+		s.queueMaxAge = time.Duration(*c.Queue.MaxAge)
+	}
+	if c.Transport != nil && !explicit["transport"] {
+		s.transport = *c.Transport
+	}
+	if c.CLI.Port != nil && !explicit["cli-port"] {
+		s.cliPort = *c.CLI.Port
+	}
+	if c.CLI.Secret != nil && !explicit["cli-secret"] {
+		s.cliSecret = *c.CLI.Secret
+	}
+	if c.Auth.Tokens != nil && !explicit["auth-tokens"] {
+		s.authTokens = *c.Auth.Tokens
+	}
+	if c.Auth.HMAC != nil && !explicit["auth-hmac-keys"] {
+		s.authKeys = *c.Auth.HMAC
+	}
+	if c.Auth.MaxSkew != nil && !explicit["auth-max-skew"] {
+		s.authMaxSkew = time.Duration(*c.Auth.MaxSkew)
+	}
+}
+
+// explicitFlags returns the names of the flags given in args
+func explicitFlags(app *kingpin.Application, args []string) map[string]bool {
+	flags := map[string]bool{}
+	context, err := app.ParseContext(args)
+	if context == nil || err != nil {
+		return flags
+	}
+	for _, element := range context.Elements {
+		if flag, ok := element.Clause.(*kingpin.FlagClause); ok {
+			flags[flag.Model().Name] = true
+		}
+	}
+	return flags
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, dir string, name string, data string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := map[string]string{
+		"config.yaml": `
+port: 8001
+destport: 6081
+timeouts:
+  backend: 2s
+services:
+  - type: aws
+    tags: ["Service:varnish"]
+  - type: gce
+    name: google
+    credentials: creds.json
+    project: my-project
+    region: us-central1
+`,
+		"config.toml": `
+port = 8001
+destport = 6081
+
+[timeouts]
+backend = "2s"
+
+[[services]]
+type = "aws"
+tags = ["Service:varnish"]
+
+[[services]]
+type = "gce"
+name = "google"
+credentials = "creds.json"
+project = "my-project"
+region = "us-central1"
+`,
+	}
+
+	for name, data := range cases {
+		c, err := loadConfig(writeConfig(t, dir, name, data))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		expect(t, name, *c.Port, 8001)
+		expect(t, name, *c.Destport, 6081)
+		expect(t, name, c.Listen == nil, true)
+		expect(t, name, time.Duration(*c.Timeouts.Backend), 2*time.Second)
+		expect(t, name, len(c.Services), 2)
+		expect(t, name, c.Services[0].Tags[0], "Service:varnish")
+		expect(t, name, c.Services[1].Name, "google")
+		expect(t, name, c.Services[1].NamePrefix, "varnish")
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := map[string]struct {
+		name     string
+		data     string
+		expected string
+	}{
+		"extension":     {"config.ini", "port = 8001", "configuration files must end in"},
+		"yamlunknown":   {"config.yaml", "prot: 8001", "field prot not found"},
+		"tomlunknown":   {"config.toml", "prot = 8001", "unknown setting prot"},
+		"port":          {"config.yaml", "port: 0", "port must be between 1 and 65535, got 0"},
+		"duration":      {"config.yaml", "timeouts:\n  read: soon", "invalid duration"},
+		"status":        {"config.yaml", "status:\n  partial: 42", "status.partial must be between 100 and 599, got 42"},
+		"successcode":   {"config.yaml", "success:\n  statuses:\n    PURGE: [200, 2000]", "success.statuses.PURGE must be between 100 and 599, got 2000"},
+		"retryattempts": {"config.yaml", "retry:\n  attempts: 0", "retry.attempts must be at least 1, got 0"},
+		"retryerrors":   {"config.yaml", "retry:\n  errors: [reset, bogus]", `retry.errors: unknown error class "bogus"`},
+		"successbody":   {"config.toml", "[success]\nbody = \"(\"", "success.body is not a valid regular expression"},
+		"transport":     {"config.yaml", "transport: telnet", `transport must be http or cli, got "telnet"`},
+		"cliport":       {"config.toml", "[cli]\nport = 70000", "cli.port must be between 1 and 65535, got 70000"},
+		"coalesce":      {"config.yaml", "coalesce: -1s", "coalesce must not be negative, got -1s"},
+		"authmaxskew":   {"config.toml", "[auth]\nmaxskew = \"0s\"", "auth.maxskew must be positive, got 0s"},
+		"missingtype":   {"config.yaml", "services:\n  - file: backends.txt", "services[0] (): type is required"},
+		"unknowntype":   {"config.yaml", "services:\n  - type: azur", `services[0] (azur): unknown type "azur"`},
+		"missingfield":  {"config.toml", "[[services]]\ntype = \"static\"", "services[0] (static): file is required"},
+	}
+
+	for k, tc := range cases {
+		_, err := loadConfig(writeConfig(t, dir, tc.name, tc.data))
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Fatalf("%s: Expected error containing %q - Got %v", k, tc.expected, err)
+		}
+	}
+}
+
+func TestConfigApply(t *testing.T) {
+	newPort, newDestport := 9001, 6081
+	c := &config{Port: &newPort, Destport: &newDestport}
+
+	s := settings{port: 8005, destport: 80, cache: 60}
+	c.apply(&s, explicitFlags(app, []string{"--port=8005", "static", "backends.txt"}))
+	expect(t, "flagoverrides", s.port, 8005)
+	expect(t, "fromconfig", s.destport, 6081)
+	expect(t, "unchanged", s.cache, 60)
+}
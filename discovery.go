@@ -0,0 +1,204 @@
+package main
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/BashtonLtd/varnish-purge-proxy/providers"
+)
+
+// lookupTimeout bounds a single lookup of the backends
+const lookupTimeout = 30 * time.Second
+
+// discovery is the result of the background backend lookups
+type discovery struct {
+	// Backends is the last non-empty list of backends found
+	Backends []string
+	// LookedUp is when backends were last looked up
+	LookedUp time.Time
+	// Succeeded is when a lookup last found backends
+	Succeeded time.Time
+	// Error is why the last lookup failed, empty if it succeeded
+	Error string
+}
+
+// backendRegistry holds the backends found by lookups, shared by every
+// request. Only one lookup runs at a time, callers asking for a refresh
+// while one is running for the same state wait for its result instead of
+// starting another.
+type backendRegistry struct {
+	mu    sync.RWMutex
+	found discovery
+
+	flightMu sync.Mutex
+	flight   *refreshFlight
+	// joined is sent the state of each refresh waiting for a lookup, so
+	// that tests can tell when it has joined
+	joined chan<- *proxyState
+}
+
+// refreshFlight is a lookup in progress, done is closed when it finishes
+type refreshFlight struct {
+	state *proxyState
+	done  chan struct{}
+}
+
+// registry holds the backends purges are sent to
+var registry = newBackendRegistry()
+
+func newBackendRegistry() *backendRegistry {
+	return &backendRegistry{found: discovery{Backends: []string{}}}
+}
+
+// current returns the result of the last lookups
+func (r *backendRegistry) current() discovery {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.found
+}
+
+// backends returns the backends to send purges to
+func (r *backendRegistry) backends() []string {
+	return r.current().Backends
+}
+
+// refresh looks up the backends of the state's service, joining a lookup
+// already running for the same state. A lookup for another state, eg. the
+// one replaced by a reload, is waited for and then followed by a new one.
+func (r *backendRegistry) refresh(state *proxyState) {
+	r.run(state, true)
+}
+
+// refreshChanged looks up the backends of the state's service once its
+// watch has seen a change. A lookup already running may have read the list
+// before the change, so it is waited for and followed by a new one.
+func (r *backendRegistry) refreshChanged(state *proxyState) {
+	r.run(state, false)
+}
+
+// run looks up the backends of the state's service once no lookup is
+// running. A running lookup for the same state is joined if join is set,
+// lookups started after run was called are always joined.
+func (r *backendRegistry) run(state *proxyState, join bool) {
+	for {
+		r.flightMu.Lock()
+		f := r.flight
+		if f == nil {
+			f = &refreshFlight{state: state, done: make(chan struct{})}
+			r.flight = f
+			r.flightMu.Unlock()
+			break
+		}
+		r.flightMu.Unlock()
+		if r.joined != nil {
+			r.joined <- state
+		}
+		<-f.done
+		if join && f.state == state {
+			return
+		}
+		join = true
+	}
+
+	defer func() {
+		r.flightMu.Lock()
+		close(r.flight.done)
+		r.flight = nil
+		r.flightMu.Unlock()
+	}()
+	r.lookup(state)
+}
+
+// lookup queries the service and records the result. If the lookup fails or
+// finds none the previous list is kept, so a failing cloud API doesn't stop
+// purges reaching the servers it last knew of.
+func (r *backendRegistry) lookup(state *proxyState) {
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	start := time.Now()
+	backends, err := state.service.Backends(ctx)
+	lookupLatency.observe(time.Since(start))
+	privateIPs := providers.Addresses(backends)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.found.LookedUp = time.Now()
+	if err != nil {
+		lookupFailures.inc()
+		r.found.Error = err.Error()
+		log.Printf("Lookup failed, keeping the previous %d backends: %v\n", len(r.found.Backends), err)
+		return
+	}
+	r.found.Error = ""
+	if len(privateIPs) == 0 {
+		lookupFailures.inc()
+		if len(r.found.Backends) > 0 {
+			log.Printf("Lookup found no backends, keeping the previous %d backends\n", len(r.found.Backends))
+		}
+		return
+	}
+	if *debug {
+		log.Printf("Lookup found backends: %v\n", privateIPs)
+	}
+	r.found.Backends = privateIPs
+	r.found.Succeeded = r.found.LookedUp
+}
+
+// watch refreshes the backends each time the state's service sees a change,
+// if it watches for them, instead of waiting for the next refresh. Changes
+// seen by a service that has since been replaced are ignored.
+func (r *backendRegistry) watch(state *proxyState) {
+	w, ok := state.service.(providers.Watcher)
+	if !ok {
+		return
+	}
+	w.Notify(func() {
+		if current := loadState(); current.service == state.service && w.Watching() {
+			r.refreshChanged(current)
+		}
+	})
+}
+
+// refreshInterval returns the time between lookups for a --cache setting
+func refreshInterval(cache int) time.Duration {
+	if cache < 1 {
+		return time.Second
+	}
+	return time.Duration(cache) * time.Second
+}
+
+// refreshLoop looks up backends in the background every --cache seconds
+// until stop is closed, using the state current at the time
+func (r *backendRegistry) refreshLoop(stop <-chan struct{}) {
+	for {
+		timer := time.NewTimer(refreshInterval(loadState().settings.cache))
+		select {
+		case <-timer.C:
+			r.refresh(loadState())
+		case <-stop:
+			timer.Stop()
+			return
+		}
+	}
+}
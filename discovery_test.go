@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BashtonLtd/varnish-purge-proxy/providers"
+)
+
+// changingService returns whatever backends or error it was last given
+type changingService struct {
+	mu       sync.Mutex
+	backends []string
+	err      error
+}
+
+func (c *changingService) Auth() error { return nil }
+
+func (c *changingService) Backends(ctx context.Context) ([]providers.Backend, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	return toBackends(c.backends), nil
+}
+
+func (c *changingService) set(backends ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.backends = backends
+	c.err = nil
+}
+
+func (c *changingService) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+}
+
+func TestRefreshBackends(t *testing.T) {
+	service := &changingService{}
+	state := &proxyState{service: service}
+	r := newBackendRegistry()
+
+	r.refresh(state)
+	expect(t, "none", len(r.current().Backends), 0)
+	expect(t, "neversucceeded", r.current().Succeeded.IsZero(), true)
+	expect(t, "lookedup", r.current().LookedUp.IsZero(), false)
+
+	service.set("10.0.0.1", "10.0.0.2")
+	r.refresh(state)
+	found := r.current()
+	expect(t, "found", len(found.Backends), 2)
+	expect(t, "succeeded", found.Succeeded.IsZero(), false)
+
+	// A failed lookup keeps the last good list
+	service.set()
+	r.found.LookedUp = r.found.LookedUp.Add(-time.Second)
+	found = r.current()
+	r.refresh(state)
+	stale := r.current()
+	expect(t, "stale", len(stale.Backends), 2)
+	expect(t, "stalesucceeded", stale.Succeeded, found.Succeeded)
+	expect(t, "stalelookedup", stale.LookedUp.After(found.LookedUp), true)
+	expect(t, "purgebackends", len(r.backends()), 2)
+
+	// So does a lookup error
+	service.fail(errors.New("throttled"))
+	r.refresh(state)
+	expect(t, "error", len(r.current().Backends), 2)
+	expect(t, "error", r.current().Error, "throttled")
+
+	service.set("10.0.0.3")
+	r.refresh(state)
+	expect(t, "replaced", r.current().Backends[0], "10.0.0.3")
+	expect(t, "replaced", r.current().Error, "")
+}
+
+// blockingService counts lookups, each of which waits for release
+type blockingService struct {
+	lookups int32
+	started chan bool
+	release chan bool
+}
+
+func (b *blockingService) Auth() error { return nil }
+
+func (b *blockingService) Backends(ctx context.Context) ([]providers.Backend, error) {
+	atomic.AddInt32(&b.lookups, 1)
+	b.started <- true
+	<-b.release
+	return toBackends([]string{"10.0.0.1"}), nil
+}
+
+func TestRefreshSingleFlight(t *testing.T) {
+	cases := map[string]struct {
+		reloaded bool
+		changed  bool
+		lookups  int32
+	}{
+		"joined":   {false, false, 1},
+		"reloaded": {true, false, 2},
+		"changed":  {false, true, 2},
+	}
+
+	for k, tc := range cases {
+		service := &blockingService{started: make(chan bool, 2), release: make(chan bool)}
+		state := &proxyState{service: service}
+		r := newBackendRegistry()
+		joined := make(chan *proxyState, 20)
+		r.joined = joined
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			r.refresh(state)
+			wg.Done()
+		}()
+		<-service.started
+
+		// Refreshes asked for while the lookup runs wait for it
+		waiting := state
+		if tc.reloaded {
+			waiting = &proxyState{service: service}
+		}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				if tc.changed {
+					r.refreshChanged(waiting)
+				} else {
+					r.refresh(waiting)
+				}
+				wg.Done()
+			}()
+		}
+		for i := 0; i < 10; i++ {
+			<-joined
+		}
+		service.release <- true
+		if tc.lookups > 1 {
+			// The waiting refreshes share one lookup started after the
+			// first, which one of them starts and the rest join
+			<-service.started
+			for i := 0; i < 9; i++ {
+				<-joined
+			}
+			service.release <- true
+		}
+		wg.Wait()
+
+		expect(t, k, atomic.LoadInt32(&service.lookups), tc.lookups)
+		expect(t, k, len(r.current().Backends), 1)
+	}
+}
+
+// watchingService is a changingService that watches for changes itself
+type watchingService struct {
+	changingService
+	onChange func()
+}
+
+func (w *watchingService) Watching() bool { return true }
+
+func (w *watchingService) Notify(f func()) { w.onChange = f }
+
+func (w *watchingService) change(backends ...string) {
+	w.set(backends...)
+	w.onChange()
+}
+
+func TestWatchBackends(t *testing.T) {
+	received := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Method
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	service := &watchingService{}
+	service.set(backendURL.Host)
+	useService(t, settings{}, service)
+	registry.watch(loadState())
+
+	// The watch finding no backends keeps the previous ones for purges
+	service.change()
+	expect(t, "kept", len(registry.backends()), 1)
+	req := httptest.NewRequest("PURGE", "/", nil)
+	req.Header.Set("X-Purge-Regex", ".*")
+	w := httptest.NewRecorder()
+	requestHandler(w, req, loadState())
+	expect(t, "status", w.Code, 200)
+	expect(t, "received", <-received, "PURGE")
+
+	service.change("10.0.0.9")
+	expect(t, "changed", registry.backends()[0], "10.0.0.9")
+
+	// Changes seen by a service that has been replaced are ignored
+	currentState.Store(&proxyState{service: fixedService{}})
+	service.change("10.0.0.10")
+	expect(t, "replaced", registry.current().Backends[0], "10.0.0.9")
+}
+
+func TestRefreshLoop(t *testing.T) {
+	service := &blockingService{started: make(chan bool, 1), release: make(chan bool, 1)}
+	currentState.Store(&proxyState{settings: settings{cache: 0}, service: service})
+	r := newBackendRegistry()
+
+	stop := make(chan struct{})
+	done := make(chan bool)
+	go func() {
+		r.refreshLoop(stop)
+		close(done)
+	}()
+	select {
+	case <-service.started:
+	case <-time.After(3 * time.Second):
+		t.Fatal("refreshLoop did not look up backends")
+	}
+	service.release <- true
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("refreshLoop did not stop")
+	}
+	expect(t, "refreshed", len(r.current().Backends), 1)
+}
+
+func TestRefreshInterval(t *testing.T) {
+	expect(t, "zero", refreshInterval(0), time.Second)
+	expect(t, "cache", refreshInterval(60), time.Minute)
+}
@@ -0,0 +1,65 @@
+package main
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// healthHandler serves /healthz, the process is alive if it can answer
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// readyHandler serves /readyz, the proxy is ready once a lookup has found
+// backends recently enough
+func readyHandler(w http.ResponseWriter, r *http.Request, state *proxyState) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+	found := registry.current()
+	if err := checkReady(registry.backends(), found.Succeeded, state.settings.readyMaxAge); err != nil {
+		http.Error(w, err.Error(), 503)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// checkReady returns why the proxy is not ready to send purges to
+// privateIPs, last found by a lookup at succeeded
+func checkReady(privateIPs []string, succeeded time.Time, maxAge time.Duration) error {
+	if succeeded.IsZero() {
+		return fmt.Errorf("no backends have been found yet")
+	}
+	if len(privateIPs) == 0 {
+		return fmt.Errorf("no backends found")
+	}
+	if age := time.Since(succeeded); maxAge > 0 && age > maxAge {
+		return fmt.Errorf("backends last found %v ago", age.Round(time.Second))
+	}
+	return nil
+}
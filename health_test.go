@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckReady(t *testing.T) {
+	backends := []string{"10.0.0.1"}
+
+	cases := map[string]struct {
+		privateIPs []string
+		succeeded  time.Time
+		maxAge     time.Duration
+		expected   string
+	}{
+		"ready":     {backends, time.Now(), time.Minute, ""},
+		"never":     {backends, time.Time{}, time.Minute, "no backends have been found yet"},
+		"empty":     {[]string{}, time.Now(), time.Minute, "no backends found"},
+		"stale":     {backends, time.Now().Add(-2 * time.Minute), time.Minute, "backends last found 2m0s ago"},
+		"unlimited": {backends, time.Now().Add(-time.Hour), 0, ""},
+	}
+
+	for k, tc := range cases {
+		err := checkReady(tc.privateIPs, tc.succeeded, tc.maxAge)
+		if tc.expected == "" {
+			expect(t, k, err, nil)
+		} else if err == nil || err.Error() != tc.expected {
+			t.Fatalf("%s: Expected error %q - Got %v", k, tc.expected, err)
+		}
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	cases := map[string]struct {
+		service  fixedService
+		path     string
+		method   string
+		expected int
+	}{
+		"healthz":     {fixedService{}, "/healthz", "GET", 200},
+		"healthzpost": {fixedService{}, "/healthz", "POST", 405},
+		"ready":       {fixedService{"10.0.0.1"}, "/readyz", "GET", 200},
+		"notready":    {fixedService{}, "/readyz", "GET", 503},
+		"purgehealth": {fixedService{}, "/healthz", "PURGE", 500},
+	}
+
+	for k, tc := range cases {
+		useService(t, settings{readyMaxAge: time.Minute}, tc.service)
+
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		req.Header.Set("X-Purge-Regex", ".*")
+		w := httptest.NewRecorder()
+		newServer(loadState().settings).Handler.ServeHTTP(w, req)
+		expect(t, k, w.Code, tc.expected)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are written in the Prometheus text format, there are few enough
+// of them that the client library isn't needed
+const metricsPrefix = "varnish_purge_proxy_"
+
+// latencyBuckets are the upper bounds in seconds of latency histograms
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	purgesReceived  = newMetric("purges_total", "Purge requests received, by method and result.", "counter", "method", "result")
+	backendLatency  = newMetric("backend_request_duration_seconds", "Time taken to send a purge to a backend, including retries.", "histogram", "backend")
+	backendErrors   = newMetric("backend_errors_total", "Purges that failed on a backend.", "counter", "backend")
+	lookupLatency   = newMetric("discovery_duration_seconds", "Time taken to look up backends.", "histogram")
+	lookupFailures  = newMetric("discovery_failures_total", "Backend lookups that failed or found no backends.", "counter")
+	purgesCoalesced = newMetric("purges_coalesced_total", "Purge requests merged into an identical purge.", "counter")
+
+	metrics = []*metric{purgesReceived, backendLatency, backendErrors, lookupLatency, lookupFailures, purgesCoalesced}
+)
+
+// metric is a counter or histogram with a series for each set of label
+// values
+type metric struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labels  []string
+	value   float64
+	count   uint64
+	buckets []uint64
+}
+
+func newMetric(name string, help string, kind string, labels ...string) *metric {
+	return &metric{name: metricsPrefix + name, help: help, kind: kind, labels: labels, series: map[string]*series{}}
+}
+
+func (m *metric) get(values []string) *series {
+	key := strings.Join(values, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labels: values}
+		if m.kind == "histogram" {
+			s.buckets = make([]uint64, len(latencyBuckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// inc adds one to a counter
+func (m *metric) inc(values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(values).value++
+}
+
+// observe records a duration in a histogram
+func (m *metric) observe(d time.Duration, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(values)
+	seconds := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.value += seconds
+	s.count++
+}
+
+func (m *metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, labelString(m.labels, s.labels, ""), formatFloat(s.value))
+			continue
+		}
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labelString(m.labels, s.labels, formatFloat(bound)), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labelString(m.labels, s.labels, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labelString(m.labels, s.labels, ""), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, labelString(m.labels, s.labels, ""), s.count)
+	}
+}
+
+// labelString formats label names and values, with le added for histogram
+// buckets
+func labelString(names []string, values []string, le string) string {
+	pairs := []string{}
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", name, strconv.Quote(values[i])))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("le=%q", le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func writeGauge(w io.Writer, name string, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s%s %s\n# TYPE %s%s gauge\n%s%s %s\n", metricsPrefix, name, help, metricsPrefix, name, metricsPrefix, name, formatFloat(value))
+}
+
+// metricsHandler serves GET /metrics
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metrics {
+		m.write(w)
+	}
+	found := registry.current()
+	writeGauge(w, "backends", "Number of backends found by the last successful lookup.", float64(len(found.Backends)))
+	age := 0.0
+	if !found.LookedUp.IsZero() {
+		age = time.Since(found.LookedUp).Seconds()
+	}
+	writeGauge(w, "backends_age_seconds", "Time since the backends were last looked up.", age)
+	lastSuccess := 0.0
+	if !found.Succeeded.IsZero() {
+		lastSuccess = float64(found.Succeeded.UnixNano()) / 1e9
+	}
+	writeGauge(w, "discovery_last_success_timestamp_seconds", "Unix time a lookup last found backends.", lastSuccess)
+	if purgeJobs != nil {
+		writeGauge(w, "queue_depth", "Queued purges waiting for a worker.", float64(purgeJobs.status().Depth))
+	}
+}
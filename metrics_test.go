@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricWrite(t *testing.T) {
+	counter := newMetric("test_total", "A test counter.", "counter", "method", "result")
+	counter.inc("PURGE", "ok")
+	counter.inc("PURGE", "ok")
+	counter.inc("PURGE", `fail"ed`)
+
+	histogram := newMetric("test_seconds", "A test histogram.", "histogram", "backend")
+	histogram.observe(20*time.Millisecond, "10.0.0.1:80")
+	histogram.observe(3*time.Second, "10.0.0.1:80")
+
+	var b bytes.Buffer
+	counter.write(&b)
+	histogram.write(&b)
+	out := b.String()
+
+	for _, expected := range []string{
+		"# TYPE varnish_purge_proxy_test_total counter\n",
+		`varnish_purge_proxy_test_total{method="PURGE",result="ok"} 2` + "\n",
+		`varnish_purge_proxy_test_total{method="PURGE",result="fail\"ed"} 1` + "\n",
+		"# TYPE varnish_purge_proxy_test_seconds histogram\n",
+		`varnish_purge_proxy_test_seconds_bucket{backend="10.0.0.1:80",le="0.01"} 0` + "\n",
+		`varnish_purge_proxy_test_seconds_bucket{backend="10.0.0.1:80",le="0.025"} 1` + "\n",
+		`varnish_purge_proxy_test_seconds_bucket{backend="10.0.0.1:80",le="5"} 2` + "\n",
+		`varnish_purge_proxy_test_seconds_bucket{backend="10.0.0.1:80",le="+Inf"} 2` + "\n",
+		`varnish_purge_proxy_test_seconds_sum{backend="10.0.0.1:80"} 3.02` + "\n",
+		`varnish_purge_proxy_test_seconds_count{backend="10.0.0.1:80"} 2` + "\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Fatalf("Expected output to contain %q - Got:\n%s", expected, out)
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	registry = &backendRegistry{found: discovery{Backends: []string{"10.0.0.1", "10.0.0.2"}, LookedUp: time.Now().Add(-time.Minute)}}
+	purgesReceived.inc("PURGE", "ok")
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	expect(t, "status", w.Code, 200)
+	out := w.Body.String()
+	for _, expected := range []string{
+		"varnish_purge_proxy_purges_total{method=\"PURGE\",result=\"ok\"}",
+		"varnish_purge_proxy_backends 2\n",
+		"varnish_purge_proxy_backends_age_seconds 6",
+		"# TYPE varnish_purge_proxy_discovery_duration_seconds histogram\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Fatalf("Expected output to contain %q - Got:\n%s", expected, out)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("POST", "/metrics", nil))
+	expect(t, "post", w.Code, 405)
+}
+
+func TestMetricsInvalidMethods(t *testing.T) {
+	for _, method := range []string{"AAA", "BBB", "CCC"} {
+		requestHandler(httptest.NewRecorder(), httptest.NewRequest(method, "/", nil), nil)
+	}
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	out := w.Body.String()
+	expect(t, "other", strings.Contains(out, `varnish_purge_proxy_purges_total{method="other",result="invalid"} `), true)
+	expect(t, "method", strings.Contains(out, `method="AAA"`), false)
+}
@@ -20,6 +20,7 @@ package providers
  */
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"strings"
@@ -52,32 +53,44 @@ func (a *AWSProvider) Auth() error {
 	return nil
 }
 
-// GetPrivateIPs returns the IPs of instances matching specific tags
-func (a *AWSProvider) GetPrivateIPs() []string {
-	instances := []string{}
+// Backends returns the instances matching specific tags
+func (a *AWSProvider) Backends(ctx context.Context) ([]Backend, error) {
 	filters, err := a.buildFilter()
 	if err != nil {
-		log.Println(err)
+		return nil, err
 	}
 
-	request := ec2.DescribeInstancesInput{Filters: filters}
-	result, err := a.Service.DescribeInstances(&request)
-	if err != nil {
-		log.Println(err)
+	req, result := a.Service.DescribeInstancesRequest(&ec2.DescribeInstancesInput{Filters: filters})
+	req.HTTPRequest = req.HTTPRequest.WithContext(ctx)
+	if err := req.Send(); err != nil {
+		return nil, fmt.Errorf("failed to describe instances: %v", err)
 	}
 
+	instances := []Backend{}
 	for _, reservation := range result.Reservations {
 		for _, instance := range reservation.Instances {
-			if instance.PrivateIpAddress != nil {
-				if a.Debug {
-					log.Printf("Adding %s to IP list\n", *instance.PrivateIpAddress)
-				}
-				instances = append(instances, *instance.PrivateIpAddress)
+			if instance.PrivateIpAddress == nil {
+				continue
+			}
+			if a.Debug {
+				log.Printf("Adding %s to IP list\n", *instance.PrivateIpAddress)
+			}
+			backend := Backend{
+				Address:    *instance.PrivateIpAddress,
+				InstanceID: aws.StringValue(instance.InstanceId),
+				Labels:     map[string]string{},
+			}
+			if instance.Placement != nil {
+				backend.Zone = aws.StringValue(instance.Placement.AvailabilityZone)
+			}
+			for _, tag := range instance.Tags {
+				backend.Labels[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
 			}
+			instances = append(instances, backend)
 		}
 	}
 
-	return instances
+	return instances, nil
 }
 
 func (a *AWSProvider) buildFilter() ([]*ec2.Filter, error) {
@@ -1,8 +1,17 @@
 package providers
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
 /*
@@ -54,3 +63,61 @@ func TestBuildFilterInvalid(t *testing.T) {
 	_, err := awsService.buildFilter()
 	expect(t, "buildfilterinvalid", err.Error(), "expected TAG:VALUE got machinetypevarnish")
 }
+
+// newTestEC2 returns an EC2 client talking to handler
+func newTestEC2(handler http.HandlerFunc) (*ec2.EC2, func()) {
+	server := httptest.NewServer(handler)
+	svc := ec2.New(session.New(), &aws.Config{
+		Region:      aws.String("eu-west-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	return svc, server.Close
+}
+
+func TestAWSProviderBackends(t *testing.T) {
+	svc, cleanup := newTestEC2(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<DescribeInstancesResponse><reservationSet><item><instancesSet>
+			<item>
+				<instanceId>i-0123</instanceId>
+				<privateIpAddress>10.0.0.1</privateIpAddress>
+				<placement><availabilityZone>eu-west-1a</availabilityZone></placement>
+				<tagSet><item><key>machinetype</key><value>varnish</value></item></tagSet>
+			</item>
+			<item><instanceId>i-4567</instanceId></item>
+		</instancesSet></item></reservationSet></DescribeInstancesResponse>`)
+	})
+	defer cleanup()
+
+	awsService := AWSProvider{Service: svc, Tags: []string{"machinetype:varnish"}}
+	backends, err := awsService.Backends(context.Background())
+	expect(t, "backends", err, nil)
+	expect(t, "backends", len(backends), 1)
+	expect(t, "address", backends[0].Address, "10.0.0.1")
+	expect(t, "instanceid", backends[0].InstanceID, "i-0123")
+	expect(t, "zone", backends[0].Zone, "eu-west-1a")
+	expect(t, "labels", backends[0].Labels["machinetype"], "varnish")
+}
+
+func TestAWSProviderBackendsError(t *testing.T) {
+	svc, cleanup := newTestEC2(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+		fmt.Fprint(w, `<Response><Errors><Error><Code>Unavailable</Code><Message>Try again</Message></Error></Errors></Response>`)
+	})
+	defer cleanup()
+
+	cases := map[string]struct {
+		tags []string
+	}{
+		"api":    {[]string{"machinetype:varnish"}},
+		"filter": {[]string{"machinetypevarnish"}},
+	}
+
+	for k, tc := range cases {
+		awsService := AWSProvider{Service: svc, Tags: tc.tags}
+		backends, err := awsService.Backends(context.Background())
+		expect(t, k, err != nil, true)
+		expect(t, k, len(backends), 0)
+	}
+}
@@ -0,0 +1,353 @@
+package providers
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	azureManagementURL = "https://management.azure.com"
+	azureLoginURL      = "https://login.microsoftonline.com"
+	azureMetadataURL   = "http://169.254.169.254"
+
+	azureComputeAPIVersion = "2021-03-01"
+	azureNetworkAPIVersion = "2020-11-01"
+	azureScaleSetNICAPI    = "2018-10-01"
+)
+
+// AzureProvider struct
+type AzureProvider struct {
+	SubscriptionID string
+	ResourceGroup  string
+	Tags           []string
+	ScaleSets      bool
+	Debug          bool
+
+	// Endpoints, only overridden in tests or for sovereign clouds
+	ManagementURL string
+	LoginURL      string
+	MetadataURL   string
+
+	client       *http.Client
+	tags         map[string]string
+	tenantID     string
+	clientID     string
+	clientSecret string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+type azureToken struct {
+	AccessToken string      `json:"access_token"`
+	ExpiresIn   json.Number `json:"expires_in"`
+}
+
+type azureResource struct {
+	ID    string            `json:"id"`
+	Name  string            `json:"name"`
+	Tags  map[string]string `json:"tags"`
+	Zones []string          `json:"zones"`
+}
+
+type azureNetworkInterface struct {
+	Properties struct {
+		VirtualMachine *struct {
+			ID string `json:"id"`
+		} `json:"virtualMachine"`
+		IPConfigurations []struct {
+			Properties struct {
+				PrivateIPAddress string `json:"privateIPAddress"`
+			} `json:"properties"`
+		} `json:"ipConfigurations"`
+	} `json:"properties"`
+}
+
+// Auth takes config values and configures this service, using a service
+// principal from AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET
+// if set and the instance's managed identity otherwise
+func (a *AzureProvider) Auth() error {
+	if a.SubscriptionID == "" {
+		a.SubscriptionID = os.Getenv("AZURE_SUBSCRIPTION_ID")
+	}
+	if a.SubscriptionID == "" {
+		return fmt.Errorf("no subscription ID given")
+	}
+	if a.ResourceGroup == "" {
+		return fmt.Errorf("no resource group given")
+	}
+	if a.ManagementURL == "" {
+		a.ManagementURL = azureManagementURL
+	}
+	if a.LoginURL == "" {
+		a.LoginURL = azureLoginURL
+	}
+	if a.MetadataURL == "" {
+		a.MetadataURL = azureMetadataURL
+	}
+
+	tags, err := a.parseTags()
+	if err != nil {
+		return err
+	}
+	a.tags = tags
+
+	a.tenantID = os.Getenv("AZURE_TENANT_ID")
+	a.clientID = os.Getenv("AZURE_CLIENT_ID")
+	a.clientSecret = os.Getenv("AZURE_CLIENT_SECRET")
+	a.client = &http.Client{Timeout: 10 * time.Second}
+
+	_, err = a.getToken()
+	return err
+}
+
+// Backends returns the VMs or scale set instances in the resource group
+// matching specific tags
+func (a *AzureProvider) Backends(ctx context.Context) ([]Backend, error) {
+	if a.ScaleSets {
+		return a.scaleSetBackends(ctx)
+	}
+	return a.virtualMachineBackends(ctx)
+}
+
+func (a *AzureProvider) parseTags() (map[string]string, error) {
+	tags := map[string]string{}
+	for _, tag := range a.Tags {
+		parts := strings.SplitN(tag, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected TAG:VALUE got %s", tag)
+		}
+		tags[parts[0]] = parts[1]
+	}
+	return tags, nil
+}
+
+func (a *AzureProvider) matchesTags(r azureResource) bool {
+	for k, v := range a.tags {
+		if r.Tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *AzureProvider) virtualMachineBackends(ctx context.Context) ([]Backend, error) {
+	var vms []azureResource
+	if err := a.list(ctx, a.resourcePath("Microsoft.Compute/virtualMachines"), azureComputeAPIVersion, &vms); err != nil {
+		return nil, fmt.Errorf("failed to list virtual machines: %v", err)
+	}
+	matched := map[string]azureResource{}
+	for _, vm := range vms {
+		if a.matchesTags(vm) {
+			if a.Debug {
+				log.Printf("Found virtual machine: %s\n", vm.Name)
+			}
+			matched[strings.ToLower(vm.ID)] = vm
+		}
+	}
+
+	var nics []azureNetworkInterface
+	if err := a.list(ctx, a.resourcePath("Microsoft.Network/networkInterfaces"), azureNetworkAPIVersion, &nics); err != nil {
+		return nil, fmt.Errorf("failed to list network interfaces: %v", err)
+	}
+	instances := []Backend{}
+	for _, nic := range nics {
+		ref := nic.Properties.VirtualMachine
+		if ref == nil {
+			continue
+		}
+		vm, ok := matched[strings.ToLower(ref.ID)]
+		if !ok {
+			continue
+		}
+		instances = append(instances, a.nicBackends(nic, vm.Name, vm)...)
+	}
+	return instances, nil
+}
+
+func (a *AzureProvider) scaleSetBackends(ctx context.Context) ([]Backend, error) {
+	var scaleSets []azureResource
+	if err := a.list(ctx, a.resourcePath("Microsoft.Compute/virtualMachineScaleSets"), azureComputeAPIVersion, &scaleSets); err != nil {
+		return nil, fmt.Errorf("failed to list scale sets: %v", err)
+	}
+
+	instances := []Backend{}
+	for _, ss := range scaleSets {
+		if !a.matchesTags(ss) {
+			continue
+		}
+		if a.Debug {
+			log.Printf("Found scale set: %s\n", ss.Name)
+		}
+		var nics []azureNetworkInterface
+		path := a.resourcePath("Microsoft.Compute/virtualMachineScaleSets/" + url.PathEscape(ss.Name) + "/networkInterfaces")
+		if err := a.list(ctx, path, azureScaleSetNICAPI, &nics); err != nil {
+			return nil, fmt.Errorf("failed to list network interfaces of scale set %s: %v", ss.Name, err)
+		}
+		for _, nic := range nics {
+			// Scale set instances are named after the scale set and
+			// their instance ID, the last part of the VM resource ID
+			name := ss.Name
+			if ref := nic.Properties.VirtualMachine; ref != nil {
+				name = ss.Name + "_" + ref.ID[strings.LastIndex(ref.ID, "/")+1:]
+			}
+			instances = append(instances, a.nicBackends(nic, name, ss)...)
+		}
+	}
+	return instances, nil
+}
+
+// nicBackends returns a backend for each private IP of nic, labelled with
+// the tags and zone of the VM or scale set it belongs to
+func (a *AzureProvider) nicBackends(nic azureNetworkInterface, name string, owner azureResource) []Backend {
+	backends := []Backend{}
+	for _, config := range nic.Properties.IPConfigurations {
+		if ip := config.Properties.PrivateIPAddress; ip != "" {
+			if a.Debug {
+				log.Printf("Adding %s to IP list\n", ip)
+			}
+			backend := Backend{Address: ip, InstanceID: name, Labels: owner.Tags}
+			if len(owner.Zones) > 0 {
+				backend.Zone = owner.Zones[0]
+			}
+			backends = append(backends, backend)
+		}
+	}
+	return backends
+}
+
+func (a *AzureProvider) resourcePath(resource string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/%s",
+		url.PathEscape(a.SubscriptionID), url.PathEscape(a.ResourceGroup), resource)
+}
+
+// list fetches every page of an ARM list operation into out, which must be
+// a pointer to a slice
+func (a *AzureProvider) list(ctx context.Context, path string, apiVersion string, out interface{}) error {
+	token, err := a.getToken()
+	if err != nil {
+		return err
+	}
+
+	var items []json.RawMessage
+	next := fmt.Sprintf("%s%s?api-version=%s", a.ManagementURL, path, apiVersion)
+	for next != "" {
+		req, err := http.NewRequest("GET", next, nil)
+		if err != nil {
+			return err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		var page struct {
+			Value    []json.RawMessage `json:"value"`
+			NextLink string            `json:"nextLink"`
+		}
+		if err := a.do(req, &page); err != nil {
+			return err
+		}
+		items = append(items, page.Value...)
+		next = page.NextLink
+	}
+
+	data, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// getToken returns a cached management API token, fetching a new one when
+// it is about to expire
+func (a *AzureProvider) getToken() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && time.Now().Before(a.expires) {
+		return a.token, nil
+	}
+
+	var req *http.Request
+	var err error
+	resource := a.ManagementURL + "/"
+	if a.tenantID != "" && a.clientID != "" && a.clientSecret != "" {
+		form := url.Values{}
+		form.Set("grant_type", "client_credentials")
+		form.Set("client_id", a.clientID)
+		form.Set("client_secret", a.clientSecret)
+		form.Set("resource", resource)
+		req, err = http.NewRequest("POST", fmt.Sprintf("%s/%s/oauth2/token", a.LoginURL, url.PathEscape(a.tenantID)), strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		query := url.Values{}
+		query.Set("api-version", "2018-02-01")
+		query.Set("resource", resource)
+		if a.clientID != "" {
+			// User assigned identity
+			query.Set("client_id", a.clientID)
+		}
+		req, err = http.NewRequest("GET", a.MetadataURL+"/metadata/identity/oauth2/token?"+query.Encode(), nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Metadata", "true")
+	}
+
+	var token azureToken
+	if err := a.do(req, &token); err != nil {
+		return "", fmt.Errorf("unable to acquire token: %v", err)
+	}
+	expiresIn, err := token.ExpiresIn.Int64()
+	if err != nil {
+		expiresIn = 300
+	}
+	a.token = token.AccessToken
+	// Refresh a minute early so that requests never carry an expired token
+	a.expires = time.Now().Add(time.Duration(expiresIn)*time.Second - time.Minute)
+	return a.token, nil
+}
+
+func (a *AzureProvider) do(req *http.Request, out interface{}) error {
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,190 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+const testAzureGroup = "/subscriptions/sub/resourceGroups/web/providers"
+
+// newTestARMServer stands in for the login, instance metadata and resource
+// manager endpoints, tokens are counted in tokenRequests
+func newTestARMServer(tokenRequests *int) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/tenant/oauth2/token":
+			r.ParseForm()
+			if r.Method != "POST" || r.PostForm.Get("client_secret") != "secret" || r.PostForm.Get("resource") != server.URL+"/" {
+				http.Error(w, "invalid_client", 401)
+				return
+			}
+			*tokenRequests++
+			fmt.Fprint(w, `{"access_token": "sp-token", "expires_in": "3599"}`)
+			return
+		case "/metadata/identity/oauth2/token":
+			if r.Header.Get("Metadata") != "true" {
+				http.Error(w, "Metadata header required", 400)
+				return
+			}
+			*tokenRequests++
+			fmt.Fprint(w, `{"access_token": "msi-token", "expires_in": "3599"}`)
+			return
+		}
+
+		auth := r.Header.Get("Authorization")
+		if (auth != "Bearer sp-token" && auth != "Bearer msi-token") || r.URL.Query().Get("api-version") == "" {
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+		switch r.URL.Path {
+		case testAzureGroup + "/Microsoft.Compute/virtualMachines":
+			fmt.Fprintf(w, `{"value": [
+				{"id": "%[1]s/Microsoft.Compute/virtualMachines/varnish-1", "name": "varnish-1", "tags": {"role": "varnish", "env": "live"}},
+				{"id": "%[1]s/Microsoft.Compute/virtualMachines/varnish-2", "name": "varnish-2", "tags": {"role": "varnish", "env": "stage"}},
+				{"id": "%[1]s/Microsoft.Compute/virtualMachines/web-1", "name": "web-1"}
+			]}`, testAzureGroup)
+		case testAzureGroup + "/Microsoft.Network/networkInterfaces":
+			if r.URL.Query().Get("page") == "" {
+				fmt.Fprintf(w, `{"value": [
+					{"properties": {"virtualMachine": {"id": "%[1]s/Microsoft.Compute/virtualMachines/VARNISH-1"}, "ipConfigurations": [{"properties": {"privateIPAddress": "10.3.0.1"}}]}},
+					{"properties": {"ipConfigurations": [{"properties": {"privateIPAddress": "10.3.0.99"}}]}}
+				], "nextLink": "%[2]s%[1]s/Microsoft.Network/networkInterfaces?api-version=2020-11-01&page=2"}`, testAzureGroup, server.URL)
+				return
+			}
+			fmt.Fprintf(w, `{"value": [
+				{"properties": {"virtualMachine": {"id": "%[1]s/Microsoft.Compute/virtualMachines/varnish-2"}, "ipConfigurations": [{"properties": {"privateIPAddress": "10.3.0.2"}}]}},
+				{"properties": {"virtualMachine": {"id": "%[1]s/Microsoft.Compute/virtualMachines/web-1"}, "ipConfigurations": [{"properties": {"privateIPAddress": "10.3.0.3"}}]}}
+			]}`, testAzureGroup)
+		case testAzureGroup + "/Microsoft.Compute/virtualMachineScaleSets":
+			fmt.Fprint(w, `{"value": [
+				{"name": "varnish-ss", "tags": {"role": "varnish"}},
+				{"name": "web-ss", "tags": {"role": "web"}}
+			]}`)
+		case testAzureGroup + "/Microsoft.Compute/virtualMachineScaleSets/varnish-ss/networkInterfaces":
+			fmt.Fprint(w, `{"value": [
+				{"properties": {"ipConfigurations": [{"properties": {"privateIPAddress": "10.4.0.4"}}]}},
+				{"properties": {"ipConfigurations": [{"properties": {"privateIPAddress": "10.4.0.5"}}]}}
+			]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return server
+}
+
+func setAzureEnv(tenant, client, secret string) func() {
+	vars := map[string]string{
+		"AZURE_TENANT_ID":     tenant,
+		"AZURE_CLIENT_ID":     client,
+		"AZURE_CLIENT_SECRET": secret,
+	}
+	for k, v := range vars {
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k := range vars {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+func TestAzureProvider(t *testing.T) {
+	tokenRequests := 0
+	server := newTestARMServer(&tokenRequests)
+	defer server.Close()
+
+	cases := map[string]struct {
+		tags      []string
+		scaleSets bool
+		principal bool
+		expected  []string
+	}{
+		"vms":          {[]string{"role:varnish"}, false, true, []string{"10.3.0.1", "10.3.0.2"}},
+		"vmstags":      {[]string{"role:varnish", "env:live"}, false, true, []string{"10.3.0.1"}},
+		"vmsidentity":  {[]string{"role:varnish"}, false, false, []string{"10.3.0.1", "10.3.0.2"}},
+		"scalesets":    {[]string{"role:varnish"}, true, true, []string{"10.4.0.4", "10.4.0.5"}},
+		"scalesetnone": {[]string{"role:cache"}, true, false, []string{}},
+	}
+
+	for k, tc := range cases {
+		reset := setAzureEnv("", "", "")
+		if tc.principal {
+			reset = setAzureEnv("tenant", "client", "secret")
+		}
+		azureService := AzureProvider{
+			SubscriptionID: "sub",
+			ResourceGroup:  "web",
+			Tags:           tc.tags,
+			ScaleSets:      tc.scaleSets,
+			ManagementURL:  server.URL,
+			LoginURL:       server.URL,
+			MetadataURL:    server.URL,
+		}
+		err := azureService.Auth()
+		reset()
+		expect(t, k, err, nil)
+
+		tokenRequests = 0
+		backends, err := azureService.Backends(context.Background())
+		expect(t, k, err, nil)
+		ips := Addresses(backends)
+		sort.Strings(ips)
+		if !reflect.DeepEqual(ips, tc.expected) {
+			t.Fatalf("%s: Expected %v - Got %v", k, tc.expected, ips)
+		}
+		// The token from Auth is reused
+		expect(t, k, tokenRequests, 0)
+	}
+}
+
+func TestAzureProviderAuthFailure(t *testing.T) {
+	tokenRequests := 0
+	server := newTestARMServer(&tokenRequests)
+	defer server.Close()
+
+	defer setAzureEnv("tenant", "client", "wrong")()
+	azureService := AzureProvider{
+		SubscriptionID: "sub",
+		ResourceGroup:  "web",
+		ManagementURL:  server.URL,
+		LoginURL:       server.URL,
+	}
+	err := azureService.Auth()
+	expect(t, "authfailure", err != nil && strings.Contains(err.Error(), "invalid_client"), true)
+}
+
+func TestAzureProviderInvalidTags(t *testing.T) {
+	azureService := AzureProvider{
+		SubscriptionID: "sub",
+		ResourceGroup:  "web",
+		Tags:           []string{"rolevarnish"},
+	}
+	expect(t, "invalidtags", azureService.Auth().Error(), "expected TAG:VALUE got rolevarnish")
+}
@@ -0,0 +1,258 @@
+package providers
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConsulProvider struct
+type ConsulProvider struct {
+	Address    string
+	Token      string
+	Service    string
+	Tag        string
+	Datacenter string
+	Wait       time.Duration
+	Debug      bool
+
+	client *http.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	synced    bool
+	instances []Backend
+	onChange  func()
+}
+
+type consulServiceEntry struct {
+	Node struct {
+		Address    string
+		Datacenter string
+	}
+	Service struct {
+		ID      string
+		Address string
+		Port    int
+		Meta    map[string]string
+	}
+}
+
+// Auth takes config values and configures this service, then starts a
+// blocking query loop to keep the list of healthy instances up to date
+func (c *ConsulProvider) Auth() error {
+	if c.Service == "" {
+		return fmt.Errorf("no service name given")
+	}
+	if c.Address == "" {
+		c.Address = os.Getenv("CONSUL_HTTP_ADDR")
+	}
+	if c.Address == "" {
+		c.Address = "127.0.0.1:8500"
+	}
+	if !strings.Contains(c.Address, "://") {
+		c.Address = "http://" + c.Address
+	}
+	c.Address = strings.TrimSuffix(c.Address, "/")
+	if c.Token == "" {
+		c.Token = os.Getenv("CONSUL_HTTP_TOKEN")
+	}
+	if c.Wait == 0 {
+		c.Wait = 5 * time.Minute
+	}
+	c.client = &http.Client{}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	go c.watchLoop()
+	return nil
+}
+
+// Backends returns the passing instances of the service, the result of the
+// latest blocking query is used once one has completed
+func (c *ConsulProvider) Backends(ctx context.Context) ([]Backend, error) {
+	c.mu.Lock()
+	if c.synced {
+		instances := make([]Backend, len(c.instances))
+		copy(instances, c.instances)
+		c.mu.Unlock()
+		return instances, nil
+	}
+	c.mu.Unlock()
+
+	instances, _, err := c.query(ctx, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query consul for %s: %v", c.Service, err)
+	}
+	return instances, nil
+}
+
+// Watching reports whether a blocking query has completed, after which the
+// instance list follows changes in consul
+func (c *ConsulProvider) Watching() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.synced
+}
+
+// Notify sets a function to call each time consul reports a change
+func (c *ConsulProvider) Notify(f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onChange = f
+}
+
+// Stop ends the blocking query loop
+func (c *ConsulProvider) Stop() {
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+// watchLoop runs blocking queries against the health endpoint, updating the
+// instance list each time consul reports a change
+func (c *ConsulProvider) watchLoop() {
+	var index uint64
+	backoff := time.Second
+	for {
+		instances, newIndex, err := c.query(c.ctx, index)
+		if c.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Consul query for %s failed, retrying in %v: %v\n", c.Service, backoff, err)
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+
+		if newIndex < 1 {
+			newIndex = 1
+		}
+		if newIndex == index {
+			// Wait expired without changes
+			continue
+		}
+		if newIndex < index {
+			// Index went backwards, eg. after a consul restore
+			index = 0
+		} else {
+			index = newIndex
+		}
+
+		c.mu.Lock()
+		c.instances = instances
+		c.synced = true
+		onChange := c.onChange
+		c.mu.Unlock()
+		if onChange != nil {
+			onChange()
+		}
+		if c.Debug {
+			log.Printf("Consul instances for %s: %v\n", c.Service, instances)
+		}
+	}
+}
+
+// query fetches the passing instances of the service, blocking until the
+// consul index moves past index if it is non-zero
+func (c *ConsulProvider) query(ctx context.Context, index uint64) ([]Backend, uint64, error) {
+	query := url.Values{}
+	query.Set("passing", "1")
+	if c.Tag != "" {
+		query.Set("tag", c.Tag)
+	}
+	if c.Datacenter != "" {
+		query.Set("dc", c.Datacenter)
+	}
+	timeout := 10 * time.Second
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", fmt.Sprintf("%ds", int(c.Wait/time.Second)))
+		// Consul adds up to wait/16 jitter to blocking queries
+		timeout += c.Wait + c.Wait/16
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v1/health/service/%s?%s", c.Address, url.PathEscape(c.Service), query.Encode()), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+	req = req.WithContext(ctx)
+
+	client := *c.client
+	client.Timeout = timeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, 0, fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+	newIndex, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+
+	instances := []Backend{}
+	for _, e := range entries {
+		address := e.Service.Address
+		if address == "" {
+			address = e.Node.Address
+		}
+		instances = append(instances, Backend{
+			Address:    address,
+			Port:       e.Service.Port,
+			InstanceID: e.Service.ID,
+			Zone:       e.Node.Datacenter,
+			Labels:     e.Service.Meta,
+		})
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].String() < instances[j].String()
+	})
+	return instances, newIndex, nil
+}
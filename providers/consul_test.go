@@ -0,0 +1,139 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// testConsul is a stand-in for the consul health endpoint which serves the
+// current entries and blocks index queries until the entries change
+type testConsul struct {
+	mu      sync.Mutex
+	index   int
+	entries string
+	changed chan struct{}
+}
+
+func (c *testConsul) set(entries string) {
+	c.mu.Lock()
+	c.index++
+	c.entries = entries
+	close(c.changed)
+	c.changed = make(chan struct{})
+	c.mu.Unlock()
+}
+
+func (c *testConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/health/service/varnish" || r.URL.Query().Get("passing") != "1" || r.Header.Get("X-Consul-Token") != "secret" {
+		http.Error(w, "Bad request", 400)
+		return
+	}
+
+	c.mu.Lock()
+	index, changed := c.index, c.changed
+	c.mu.Unlock()
+	if r.URL.Query().Get("index") == fmt.Sprint(index) {
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w.Header().Set("X-Consul-Index", fmt.Sprint(c.index))
+	fmt.Fprint(w, c.entries)
+}
+
+func TestConsulProvider(t *testing.T) {
+	consul := &testConsul{changed: make(chan struct{})}
+	consul.set(`[
+		{"Node": {"Address": "10.2.0.1", "Datacenter": "dc1"}, "Service": {"ID": "varnish-1", "Address": "", "Port": 6081}},
+		{"Node": {"Address": "10.2.0.2"}, "Service": {"Address": "10.2.1.2", "Port": 0}}
+	]`)
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	consulService := ConsulProvider{
+		Address: server.URL,
+		Token:   "secret",
+		Service: "varnish",
+	}
+	changes := make(chan struct{}, 1)
+	consulService.Notify(func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	})
+	expect(t, "auth", consulService.Auth(), nil)
+	defer consulService.Stop()
+
+	expected := []string{"10.2.0.1:6081", "10.2.1.2"}
+	backends, err := consulService.Backends(context.Background())
+	expect(t, "initial", err, nil)
+	if ips := Addresses(backends); !reflect.DeepEqual(ips, expected) {
+		t.Fatalf("initial: Expected %v - Got %v", expected, ips)
+	}
+	expect(t, "instanceid", backends[0].InstanceID, "varnish-1")
+	expect(t, "zone", backends[0].Zone, "dc1")
+
+	consul.set(`[{"Node": {"Address": "10.2.0.3"}, "Service": {"Port": 6081}}]`)
+	expected = []string{"10.2.0.3:6081"}
+	deadline := time.After(5 * time.Second)
+	for {
+		backends, _ := consulService.Backends(context.Background())
+		ips := Addresses(backends)
+		if reflect.DeepEqual(ips, expected) {
+			break
+		}
+		select {
+		case <-changes:
+		case <-deadline:
+			t.Fatalf("blocking: Expected %v - Got %v", expected, ips)
+		}
+	}
+	expect(t, "watching", consulService.Watching(), true)
+}
+
+func TestConsulProviderError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Permission denied", 403)
+	}))
+	defer server.Close()
+
+	consulService := ConsulProvider{
+		Address: server.URL,
+		Service: "varnish",
+		client:  &http.Client{},
+	}
+	instances, _, err := consulService.query(context.Background(), 0)
+	expect(t, "error", err != nil, true)
+	expect(t, "error", len(instances), 0)
+}
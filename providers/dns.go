@@ -0,0 +1,108 @@
+package providers
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// DNSProvider struct
+type DNSProvider struct {
+	Resolver *net.Resolver
+	Name     string
+	Server   string
+	SRV      bool
+	Debug    bool
+	Timeout  time.Duration
+}
+
+// Auth takes config values and configures this service
+func (d *DNSProvider) Auth() error {
+	if d.Name == "" {
+		return fmt.Errorf("no DNS name given")
+	}
+	if d.Timeout == 0 {
+		d.Timeout = 5 * time.Second
+	}
+
+	d.Resolver = net.DefaultResolver
+	if d.Server != "" {
+		server := d.Server
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		d.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return nil
+}
+
+// Backends returns the addresses the DNS name resolves to, SRV lookups use
+// the port from each record
+func (d *DNSProvider) Backends(ctx context.Context) ([]Backend, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.Timeout)
+	defer cancel()
+
+	instances := []Backend{}
+	if !d.SRV {
+		ips, err := d.Resolver.LookupHost(ctx, d.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %v", d.Name, err)
+		}
+		for _, ip := range ips {
+			if d.Debug {
+				log.Printf("Adding %s to IP list\n", ip)
+			}
+			instances = append(instances, Backend{Address: ip})
+		}
+		return instances, nil
+	}
+
+	_, records, err := d.Resolver.LookupSRV(ctx, "", "", d.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve SRV %s: %v", d.Name, err)
+	}
+	for _, srv := range records {
+		target := strings.TrimSuffix(srv.Target, ".")
+		ips, err := d.Resolver.LookupHost(ctx, srv.Target)
+		if err != nil {
+			log.Printf("Failed to resolve SRV target %s: %v\n", target, err)
+			continue
+		}
+		for _, ip := range ips {
+			backend := Backend{Address: ip, Port: int(srv.Port), InstanceID: target}
+			if d.Debug {
+				log.Printf("Adding %s to IP list\n", backend)
+			}
+			instances = append(instances, backend)
+		}
+	}
+	return instances, nil
+}
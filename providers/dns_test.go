@@ -0,0 +1,214 @@
+package providers
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+)
+
+type testSRV struct {
+	target string
+	port   uint16
+}
+
+// testDNSServer is a minimal authoritative DNS server answering A, AAAA and
+// SRV questions over UDP from fixed tables
+type testDNSServer struct {
+	conn  net.PacketConn
+	hosts map[string][]net.IP
+	srvs  map[string][]testSRV
+}
+
+func newTestDNSServer(t *testing.T, hosts map[string][]net.IP, srvs map[string][]testSRV) *testDNSServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testDNSServer{
+		conn:  conn,
+		hosts: hosts,
+		srvs:  srvs,
+	}
+	go s.serve()
+	return s
+}
+
+func (s *testDNSServer) Close() {
+	s.conn.Close()
+}
+
+func (s *testDNSServer) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp := s.answer(buf[:n]); resp != nil {
+			s.conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *testDNSServer) answer(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	// Read the question name
+	var labels []string
+	off := 12
+	for off < len(query) && query[off] != 0 {
+		l := int(query[off])
+		if off+1+l > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[off+1:off+1+l]))
+		off += 1 + l
+	}
+	off++
+	if off+4 > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[off:])
+	question := query[12 : off+4]
+	name := strings.ToLower(strings.Join(labels, "."))
+
+	var answers [][]byte
+	_, hostKnown := s.hosts[name]
+	_, srvKnown := s.srvs[name]
+	switch qtype {
+	case dnsTypeA, dnsTypeAAAA:
+		for _, ip := range s.hosts[name] {
+			if ip4 := ip.To4(); ip4 != nil && qtype == dnsTypeA {
+				answers = append(answers, dnsRR(qtype, ip4))
+			} else if ip4 == nil && qtype == dnsTypeAAAA {
+				answers = append(answers, dnsRR(qtype, ip.To16()))
+			}
+		}
+	case dnsTypeSRV:
+		for _, srv := range s.srvs[name] {
+			rdata := make([]byte, 6)
+			binary.BigEndian.PutUint16(rdata[0:], 10)
+			binary.BigEndian.PutUint16(rdata[2:], 10)
+			binary.BigEndian.PutUint16(rdata[4:], srv.port)
+			rdata = append(rdata, dnsName(srv.target)...)
+			answers = append(answers, dnsRR(qtype, rdata))
+		}
+	}
+
+	resp := make([]byte, 12)
+	copy(resp, query[:2])
+	// Response, authoritative, recursion desired and available
+	flags := uint16(0x8580)
+	if !hostKnown && !srvKnown {
+		flags |= 3 // NXDOMAIN
+	}
+	binary.BigEndian.PutUint16(resp[2:], flags)
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(answers)))
+	resp = append(resp, question...)
+	for _, a := range answers {
+		resp = append(resp, a...)
+	}
+	return resp
+}
+
+// dnsRR builds a resource record pointing back at the question name
+func dnsRR(qtype uint16, rdata []byte) []byte {
+	rr := []byte{0xc0, 12}
+	fixed := make([]byte, 10)
+	binary.BigEndian.PutUint16(fixed[0:], qtype)
+	binary.BigEndian.PutUint16(fixed[2:], 1)
+	binary.BigEndian.PutUint32(fixed[4:], 60)
+	binary.BigEndian.PutUint16(fixed[8:], uint16(len(rdata)))
+	rr = append(rr, fixed...)
+	return append(rr, rdata...)
+}
+
+func dnsName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func TestDNSProvider(t *testing.T) {
+	server := newTestDNSServer(t, map[string][]net.IP{
+		"varnish.test":   {net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("fd00::1")},
+		"varnish-a.test": {net.ParseIP("10.0.1.1")},
+		"varnish-b.test": {net.ParseIP("10.0.1.2")},
+	}, map[string][]testSRV{
+		"_http._tcp.varnish.test": {
+			{"varnish-a.test.", 6081},
+			{"varnish-b.test.", 6082},
+		},
+	})
+	defer server.Close()
+
+	cases := map[string]struct {
+		name     string
+		srv      bool
+		expected []string
+		failed   bool
+	}{
+		"host":    {"varnish.test.", false, []string{"10.0.0.1", "10.0.0.2", "fd00::1"}, false},
+		"srv":     {"_http._tcp.varnish.test.", true, []string{"10.0.1.1:6081", "10.0.1.2:6082"}, false},
+		"missing": {"missing.test.", false, nil, true},
+	}
+
+	for k, tc := range cases {
+		dnsService := DNSProvider{
+			Name:   tc.name,
+			Server: server.conn.LocalAddr().String(),
+			SRV:    tc.srv,
+		}
+		expect(t, k, dnsService.Auth(), nil)
+
+		backends, err := dnsService.Backends(context.Background())
+		expect(t, k, err != nil, tc.failed)
+		if tc.failed {
+			continue
+		}
+		ips := Addresses(backends)
+		sort.Strings(ips)
+		if !reflect.DeepEqual(ips, tc.expected) {
+			t.Fatalf("%s: Expected %v - Got %v", k, tc.expected, ips)
+		}
+	}
+}
+
+func TestDNSProviderNoName(t *testing.T) {
+	dnsService := DNSProvider{}
+	expect(t, "noname", dnsService.Auth().Error(), "no DNS name given")
+}
@@ -21,6 +21,7 @@ package providers
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
 
@@ -44,25 +45,23 @@ func (g *GCEProvider) Auth() error {
 	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", g.Credentials)
 	src, err := google.DefaultTokenSource(oauth2.NoContext, compute.ComputeReadonlyScope)
 	if err != nil {
-		log.Fatalf("Unable to acquire token source: %v", err)
-		return err
+		return fmt.Errorf("unable to acquire token source: %v", err)
 	}
 
 	oauthClient := oauth2.NewClient(context.Background(), src)
 
 	svc, err := compute.New(oauthClient)
 	if err != nil {
-		log.Fatal("Unable to get client: ", err)
-		return err
+		return fmt.Errorf("unable to get client: %v", err)
 	}
 	g.Service = svc
 	return nil
 }
 
-// GetPrivateIPs returns the IPs of instances matching specific tags
-func (g *GCEProvider) GetPrivateIPs() []string {
-	instances := []string{}
-	ctx := context.Background()
+// Backends returns the running instances in the region whose names contain
+// the name prefix
+func (g *GCEProvider) Backends(ctx context.Context) ([]Backend, error) {
+	instances := []Backend{}
 
 	var zones []string
 	{
@@ -75,7 +74,7 @@ func (g *GCEProvider) GetPrivateIPs() []string {
 			}
 			return nil
 		}); err != nil {
-			log.Fatal("Failed to list zones: ", err)
+			return nil, fmt.Errorf("failed to list zones: %v", err)
 		}
 	}
 
@@ -88,14 +87,18 @@ func (g *GCEProvider) GetPrivateIPs() []string {
 				log.Printf("Found instance: %s", v.Name)
 				for _, n := range v.NetworkInterfaces {
 					log.Printf("Found address: %s", n.NetworkIP)
-					instances = append(instances, n.NetworkIP)
+					instances = append(instances, Backend{
+						Address:    n.NetworkIP,
+						InstanceID: v.Name,
+						Zone:       zone,
+					})
 				}
 			}
 			return nil
 		}); err != nil {
-			log.Fatal("Failed to list instances: ", err)
+			return nil, fmt.Errorf("failed to list instances in %s: %v", zone, err)
 		}
 	}
 
-	return instances
+	return instances, nil
 }
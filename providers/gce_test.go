@@ -0,0 +1,85 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// newTestGCE returns a GCE provider whose API calls are answered by handler
+func newTestGCE(t *testing.T, handler http.HandlerFunc) (*GCEProvider, func()) {
+	server := httptest.NewServer(handler)
+	svc, err := compute.New(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.BasePath = server.URL + "/"
+	return &GCEProvider{Service: svc, NamePrefix: "varnish", Project: "web", Region: "europe-west1"}, server.Close
+}
+
+func TestGCEProviderBackends(t *testing.T) {
+	gceService, cleanup := newTestGCE(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/web/zones":
+			fmt.Fprint(w, `{"items": [{"name": "europe-west1-b"}]}`)
+		case "/web/zones/europe-west1-b/instances":
+			fmt.Fprint(w, `{"items": [{"name": "varnish-1", "networkInterfaces": [{"networkIP": "10.5.0.1"}]}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	defer cleanup()
+
+	backends, err := gceService.Backends(context.Background())
+	expect(t, "backends", err, nil)
+	expect(t, "backends", len(backends), 1)
+	expect(t, "address", backends[0].Address, "10.5.0.1")
+	expect(t, "instanceid", backends[0].InstanceID, "varnish-1")
+	expect(t, "zone", backends[0].Zone, "europe-west1-b")
+}
+
+func TestGCEProviderBackendsError(t *testing.T) {
+	cases := map[string]struct {
+		failPath string
+	}{
+		"zones":     {"/web/zones"},
+		"instances": {"/web/zones/europe-west1-b/instances"},
+	}
+
+	for k, tc := range cases {
+		gceService, cleanup := newTestGCE(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == tc.failPath {
+				http.Error(w, `{"error": {"code": 503, "message": "backend error"}}`, 503)
+				return
+			}
+			fmt.Fprint(w, `{"items": [{"name": "europe-west1-b"}]}`)
+		})
+		backends, err := gceService.Backends(context.Background())
+		cleanup()
+		expect(t, k, err != nil, true)
+		expect(t, k, len(backends), 0)
+	}
+}
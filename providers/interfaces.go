@@ -19,8 +19,57 @@ package providers
  *
  */
 
+import (
+	"context"
+	"net"
+	"strconv"
+)
+
+// Backend is a varnish server found by a service
+type Backend struct {
+	Address string `json:"address"`
+	// Port is 0 when the service does not know it, --destport is used then
+	Port       int               `json:"port,omitempty"`
+	InstanceID string            `json:"instance_id,omitempty"`
+	Zone       string            `json:"zone,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+// String returns the backend as host or host:port
+func (b Backend) String() string {
+	if b.Port == 0 {
+		return b.Address
+	}
+	return net.JoinHostPort(b.Address, strconv.Itoa(b.Port))
+}
+
+// Addresses returns the host or host:port of each backend
+func Addresses(backends []Backend) []string {
+	addresses := make([]string, len(backends))
+	for i, b := range backends {
+		addresses[i] = b.String()
+	}
+	return addresses
+}
+
 // Service defines an interface to a cloud service
 type Service interface {
 	Auth() error
-	GetPrivateIPs() []string
+	// Backends looks up the current backends, returning an error rather
+	// than an empty list when the lookup fails
+	Backends(ctx context.Context) ([]Backend, error)
+}
+
+// Watcher is implemented by services that keep their backend list up to date
+// in the background, Watching reports whether the list is current and
+// Notify sets a function to call each time it changes
+type Watcher interface {
+	Watching() bool
+	Notify(func())
+}
+
+// Stopper is implemented by services running background work, Stop ends it
+// once the service is no longer needed
+type Stopper interface {
+	Stop()
 }
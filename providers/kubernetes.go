@@ -0,0 +1,602 @@
+package providers
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	watchTimeout      = 5 * time.Minute
+)
+
+// KubernetesProvider struct
+type KubernetesProvider struct {
+	Kubeconfig     string
+	Namespace      string
+	ServiceName    string
+	PortName       string
+	EndpointSlices bool
+	Watch          bool
+	Debug          bool
+
+	client *http.Client
+	host   string
+	token  string
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	synced   bool
+	objects  map[string][]Backend
+	onChange func()
+}
+
+type k8sPort struct {
+	Name string `json:"name"`
+	Port int    `json:"port"`
+}
+
+type k8sMetadata struct {
+	Name            string `json:"name"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+type k8sTargetRef struct {
+	Name string `json:"name"`
+}
+
+type k8sEndpoints struct {
+	Metadata k8sMetadata `json:"metadata"`
+	Subsets  []struct {
+		Addresses []struct {
+			IP        string        `json:"ip"`
+			TargetRef *k8sTargetRef `json:"targetRef"`
+		} `json:"addresses"`
+		Ports []k8sPort `json:"ports"`
+	} `json:"subsets"`
+}
+
+type k8sEndpointSlice struct {
+	Metadata  k8sMetadata `json:"metadata"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+		TargetRef *k8sTargetRef `json:"targetRef"`
+		Zone      string        `json:"zone"`
+	} `json:"endpoints"`
+	Ports []k8sPort `json:"ports"`
+}
+
+type k8sList struct {
+	Metadata k8sMetadata       `json:"metadata"`
+	Items    []json.RawMessage `json:"items"`
+}
+
+type k8sWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// kubeconfig holds the parts of a kubeconfig file needed to reach the API
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+// Auth takes config values and configures this service, using the
+// kubeconfig file if given or the in-cluster service account otherwise
+func (k *KubernetesProvider) Auth() error {
+	if k.ServiceName == "" {
+		return fmt.Errorf("no service name given")
+	}
+
+	var err error
+	if k.Kubeconfig != "" {
+		err = k.loadKubeconfig()
+	} else {
+		err = k.loadInCluster()
+	}
+	if err != nil {
+		return err
+	}
+	if k.Namespace == "" {
+		k.Namespace = "default"
+	}
+
+	k.ctx, k.cancel = context.WithCancel(context.Background())
+	if k.Watch {
+		go k.watchLoop()
+	}
+	return nil
+}
+
+// Backends returns the ready endpoints of the service, when watching the
+// last state seen by the watch is returned
+func (k *KubernetesProvider) Backends(ctx context.Context) ([]Backend, error) {
+	k.mu.Lock()
+	if k.Watch && k.synced {
+		instances := flattenObjects(k.objects)
+		k.mu.Unlock()
+		return instances, nil
+	}
+	k.mu.Unlock()
+
+	objects, _, err := k.list(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list endpoints for %s/%s: %v", k.Namespace, k.ServiceName, err)
+	}
+	instances := flattenObjects(objects)
+	if k.Debug {
+		for _, b := range instances {
+			log.Printf("Adding %s to IP list\n", b)
+		}
+	}
+	return instances, nil
+}
+
+// Watching reports whether the endpoints are being watched and the initial
+// list has been received
+func (k *KubernetesProvider) Watching() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.Watch && k.synced
+}
+
+// Notify sets a function to call each time the watch changes the endpoints
+func (k *KubernetesProvider) Notify(f func()) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.onChange = f
+}
+
+// changed calls the function given to Notify, if any
+func (k *KubernetesProvider) changed() {
+	k.mu.Lock()
+	onChange := k.onChange
+	k.mu.Unlock()
+	if onChange != nil {
+		onChange()
+	}
+}
+
+// Stop ends the watch of the endpoints
+func (k *KubernetesProvider) Stop() {
+	if k.cancel != nil {
+		k.cancel()
+	}
+}
+
+func (k *KubernetesProvider) loadInCluster() error {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return fmt.Errorf("not running in a cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set or a kubeconfig given")
+	}
+	token, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return err
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return fmt.Errorf("no certificates found in %s", filepath.Join(serviceAccountDir, "ca.crt"))
+	}
+	if k.Namespace == "" {
+		if ns, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "namespace")); err == nil {
+			k.Namespace = strings.TrimSpace(string(ns))
+		}
+	}
+
+	k.host = "https://" + net.JoinHostPort(host, port)
+	k.token = strings.TrimSpace(string(token))
+	k.client = newKubernetesClient(&tls.Config{RootCAs: pool})
+	return nil
+}
+
+func (k *KubernetesProvider) loadKubeconfig() error {
+	data, err := ioutil.ReadFile(k.Kubeconfig)
+	if err != nil {
+		return err
+	}
+	var config kubeconfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("unable to parse %s: %v", k.Kubeconfig, err)
+	}
+	// Relative paths in a kubeconfig are relative to the file itself
+	dir := filepath.Dir(k.Kubeconfig)
+	resolve := func(path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+
+	var clusterName, userName string
+	found := false
+	for _, c := range config.Contexts {
+		if c.Name == config.CurrentContext {
+			clusterName, userName = c.Context.Cluster, c.Context.User
+			if k.Namespace == "" {
+				k.Namespace = c.Context.Namespace
+			}
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("context %q not found in %s", config.CurrentContext, k.Kubeconfig)
+	}
+
+	tlsConfig := &tls.Config{}
+	found = false
+	for _, c := range config.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		found = true
+		k.host = strings.TrimSuffix(c.Cluster.Server, "/")
+		tlsConfig.InsecureSkipVerify = c.Cluster.InsecureSkipTLSVerify
+		ca, err := fileOrData(resolve(c.Cluster.CertificateAuthority), c.Cluster.CertificateAuthorityData)
+		if err != nil {
+			return err
+		}
+		if ca != nil {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return fmt.Errorf("no certificates found for cluster %s", clusterName)
+			}
+			tlsConfig.RootCAs = pool
+		}
+	}
+	if !found {
+		return fmt.Errorf("cluster %q not found in %s", clusterName, k.Kubeconfig)
+	}
+
+	for _, u := range config.Users {
+		if u.Name != userName {
+			continue
+		}
+		k.token = u.User.Token
+		if u.User.TokenFile != "" {
+			token, err := ioutil.ReadFile(resolve(u.User.TokenFile))
+			if err != nil {
+				return err
+			}
+			k.token = strings.TrimSpace(string(token))
+		}
+		cert, err := fileOrData(resolve(u.User.ClientCertificate), u.User.ClientCertificateData)
+		if err != nil {
+			return err
+		}
+		key, err := fileOrData(resolve(u.User.ClientKey), u.User.ClientKeyData)
+		if err != nil {
+			return err
+		}
+		if cert != nil && key != nil {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return err
+			}
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+	}
+
+	k.client = newKubernetesClient(tlsConfig)
+	return nil
+}
+
+// fileOrData returns the contents of path, or the base64 decoded data if
+// no path is given
+func fileOrData(path, data string) ([]byte, error) {
+	if path != "" {
+		return ioutil.ReadFile(path)
+	}
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	return nil, nil
+}
+
+func newKubernetesClient(tlsConfig *tls.Config) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// resource returns the API path and selector for the service's endpoints
+func (k *KubernetesProvider) resource() (string, url.Values) {
+	query := url.Values{}
+	if k.EndpointSlices {
+		query.Set("labelSelector", "kubernetes.io/service-name="+k.ServiceName)
+		return fmt.Sprintf("/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices", url.PathEscape(k.Namespace)), query
+	}
+	query.Set("fieldSelector", "metadata.name="+k.ServiceName)
+	return fmt.Sprintf("/api/v1/namespaces/%s/endpoints", url.PathEscape(k.Namespace)), query
+}
+
+func (k *KubernetesProvider) get(ctx context.Context, query url.Values, timeout time.Duration) (*http.Response, error) {
+	path, selector := k.resource()
+	for key, values := range query {
+		selector[key] = values
+	}
+	req, err := http.NewRequest("GET", k.host+path+"?"+selector.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if k.token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.token)
+	}
+	req.Header.Set("Accept", "application/json")
+	req = req.WithContext(ctx)
+
+	client := *k.client
+	client.Timeout = timeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// list fetches the current endpoints, returning the backends keyed by
+// object name and the resource version to watch from
+func (k *KubernetesProvider) list(ctx context.Context) (map[string][]Backend, string, error) {
+	resp, err := k.get(ctx, url.Values{}, 10*time.Second)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	var list k8sList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, "", err
+	}
+	objects := map[string][]Backend{}
+	for _, item := range list.Items {
+		name, addresses, err := k.parseObject(item)
+		if err != nil {
+			return nil, "", err
+		}
+		objects[name] = addresses
+	}
+	return objects, list.Metadata.ResourceVersion, nil
+}
+
+// parseObject returns the name and ready backends of an Endpoints or
+// EndpointSlice object
+func (k *KubernetesProvider) parseObject(raw json.RawMessage) (string, []Backend, error) {
+	addresses := []Backend{}
+	if k.EndpointSlices {
+		var slice k8sEndpointSlice
+		if err := json.Unmarshal(raw, &slice); err != nil {
+			return "", nil, err
+		}
+		port, ok := k.findPort(slice.Ports)
+		if !ok {
+			return slice.Metadata.Name, addresses, nil
+		}
+		for _, e := range slice.Endpoints {
+			if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+				continue
+			}
+			for _, ip := range e.Addresses {
+				backend := Backend{Address: ip, Port: port, Zone: e.Zone}
+				if e.TargetRef != nil {
+					backend.InstanceID = e.TargetRef.Name
+				}
+				addresses = append(addresses, backend)
+			}
+		}
+		return slice.Metadata.Name, addresses, nil
+	}
+
+	var endpoints k8sEndpoints
+	if err := json.Unmarshal(raw, &endpoints); err != nil {
+		return "", nil, err
+	}
+	for _, subset := range endpoints.Subsets {
+		port, ok := k.findPort(subset.Ports)
+		if !ok {
+			continue
+		}
+		for _, a := range subset.Addresses {
+			backend := Backend{Address: a.IP, Port: port}
+			if a.TargetRef != nil {
+				backend.InstanceID = a.TargetRef.Name
+			}
+			addresses = append(addresses, backend)
+		}
+	}
+	return endpoints.Metadata.Name, addresses, nil
+}
+
+// findPort returns the port named PortName, if no port name is configured
+// the global destination port is used
+func (k *KubernetesProvider) findPort(ports []k8sPort) (int, bool) {
+	if k.PortName == "" {
+		return 0, true
+	}
+	for _, p := range ports {
+		if p.Name == k.PortName {
+			return p.Port, true
+		}
+	}
+	if k.Debug {
+		log.Printf("No port named %s in %+v\n", k.PortName, ports)
+	}
+	return 0, false
+}
+
+// watchLoop keeps objects up to date, re-listing whenever the watch ends
+func (k *KubernetesProvider) watchLoop() {
+	backoff := time.Second
+	for {
+		objects, version, err := k.list(k.ctx)
+		if err == nil {
+			k.mu.Lock()
+			k.objects = objects
+			k.synced = true
+			k.mu.Unlock()
+			k.changed()
+			err = k.watch(version)
+		}
+		if k.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Watch of %s/%s failed, retrying in %v: %v\n", k.Namespace, k.ServiceName, backoff, err)
+			select {
+			case <-k.ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+	}
+}
+
+// watch applies events from the API server until the watch times out
+func (k *KubernetesProvider) watch(version string) error {
+	query := url.Values{}
+	query.Set("watch", "1")
+	query.Set("resourceVersion", version)
+	query.Set("timeoutSeconds", strconv.Itoa(int(watchTimeout/time.Second)))
+	resp, err := k.get(k.ctx, query, watchTimeout+30*time.Second)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event k8sWatchEvent
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		switch event.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			name, addresses, err := k.parseObject(event.Object)
+			if err != nil {
+				return err
+			}
+			k.mu.Lock()
+			if event.Type == "DELETED" {
+				delete(k.objects, name)
+			} else {
+				k.objects[name] = addresses
+			}
+			k.mu.Unlock()
+			k.changed()
+			if k.Debug {
+				log.Printf("Endpoints %s %s: %v\n", name, strings.ToLower(event.Type), addresses)
+			}
+		case "ERROR":
+			return fmt.Errorf("watch error: %s", event.Object)
+		}
+	}
+}
+
+// flattenObjects returns the de-duplicated backends of all objects, sorted
+// by address
+func flattenObjects(objects map[string][]Backend) []Backend {
+	seen := map[string]bool{}
+	instances := []Backend{}
+	for _, backends := range objects {
+		for _, b := range backends {
+			if !seen[b.String()] {
+				seen[b.String()] = true
+				instances = append(instances, b)
+			}
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].String() < instances[j].String()
+	})
+	return instances
+}
@@ -0,0 +1,224 @@
+package providers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+const testEndpoints = `{"metadata": {"resourceVersion": "10"}, "items": [{
+	"metadata": {"name": "varnish"},
+	"subsets": [
+		{"addresses": [{"ip": "10.1.0.1"}, {"ip": "10.1.0.2"}], "ports": [{"name": "http", "port": 6081}]},
+		{"addresses": [{"ip": "10.1.0.3"}], "ports": [{"name": "admin", "port": 6082}]}
+	]
+}]}`
+
+const testEndpointSlices = `{"metadata": {"resourceVersion": "20"}, "items": [
+	{
+		"metadata": {"name": "varnish-abc"},
+		"endpoints": [
+			{"addresses": ["10.1.0.1"], "conditions": {"ready": true}},
+			{"addresses": ["10.1.0.2"], "conditions": {"ready": false}},
+			{"addresses": ["10.1.0.3"], "conditions": {}}
+		],
+		"ports": [{"name": "http", "port": 6081}]
+	},
+	{
+		"metadata": {"name": "varnish-def"},
+		"endpoints": [{"addresses": ["10.1.0.4"]}],
+		"ports": [{"name": "http", "port": 6081}]
+	}
+]}`
+
+// newTestAPIServer returns a TLS API server stand-in and a kubeconfig for it
+func newTestAPIServer(t *testing.T, handler http.HandlerFunc) (*httptest.Server, string, func()) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+		handler(w, r)
+	}))
+
+	dir, err := ioutil.TempDir("", "kubernetes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	config := fmt.Sprintf(`apiVersion: v1
+kind: Config
+current-context: test
+clusters:
+- name: test-cluster
+  cluster:
+    server: %s
+    certificate-authority-data: %s
+users:
+- name: test-user
+  user:
+    token: secret
+contexts:
+- name: test
+  context:
+    cluster: test-cluster
+    user: test-user
+    namespace: web
+`, server.URL, base64.StdEncoding.EncodeToString(ca))
+	path := filepath.Join(dir, "kubeconfig")
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return server, path, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestKubernetesProvider(t *testing.T) {
+	server, kubeconfig, cleanup := newTestAPIServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/namespaces/web/endpoints":
+			if r.URL.Query().Get("fieldSelector") != "metadata.name=varnish" {
+				http.Error(w, "Bad selector", 400)
+				return
+			}
+			fmt.Fprint(w, testEndpoints)
+		case "/apis/discovery.k8s.io/v1/namespaces/web/endpointslices":
+			if r.URL.Query().Get("labelSelector") != "kubernetes.io/service-name=varnish" {
+				http.Error(w, "Bad selector", 400)
+				return
+			}
+			fmt.Fprint(w, testEndpointSlices)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	defer cleanup()
+
+	cases := map[string]struct {
+		slices   bool
+		portName string
+		expected []string
+	}{
+		"endpoints":      {false, "", []string{"10.1.0.1", "10.1.0.2", "10.1.0.3"}},
+		"endpointsport":  {false, "http", []string{"10.1.0.1:6081", "10.1.0.2:6081"}},
+		"endpointslices": {true, "", []string{"10.1.0.1", "10.1.0.3", "10.1.0.4"}},
+		"slicesport":     {true, "http", []string{"10.1.0.1:6081", "10.1.0.3:6081", "10.1.0.4:6081"}},
+		"slicesnoport":   {true, "admin", []string{}},
+	}
+
+	for k, tc := range cases {
+		k8sService := KubernetesProvider{
+			Kubeconfig:     kubeconfig,
+			ServiceName:    "varnish",
+			PortName:       tc.portName,
+			EndpointSlices: tc.slices,
+		}
+		expect(t, k, k8sService.Auth(), nil)
+		expect(t, k, k8sService.host, server.URL)
+
+		backends, err := k8sService.Backends(context.Background())
+		expect(t, k, err, nil)
+		if ips := Addresses(backends); !reflect.DeepEqual(ips, tc.expected) {
+			t.Fatalf("%s: Expected %v - Got %v", k, tc.expected, ips)
+		}
+	}
+}
+
+func TestKubernetesProviderWatch(t *testing.T) {
+	done := make(chan struct{})
+	_, kubeconfig, cleanup := newTestAPIServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") == "" {
+			fmt.Fprint(w, testEndpoints)
+			return
+		}
+		if r.URL.Query().Get("resourceVersion") != "10" {
+			http.Error(w, "Bad resourceVersion", 400)
+			return
+		}
+		fmt.Fprint(w, `{"type": "MODIFIED", "object": {"metadata": {"name": "varnish"}, "subsets": [{"addresses": [{"ip": "10.1.0.9"}]}]}}`)
+		w.(http.Flusher).Flush()
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	defer cleanup()
+	defer close(done)
+
+	k8sService := KubernetesProvider{
+		Kubeconfig:  kubeconfig,
+		ServiceName: "varnish",
+		Watch:       true,
+	}
+	changes := make(chan struct{}, 1)
+	k8sService.Notify(func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	})
+	expect(t, "auth", k8sService.Auth(), nil)
+	defer k8sService.Stop()
+
+	deadline := time.After(5 * time.Second)
+	for {
+		backends, _ := k8sService.Backends(context.Background())
+		ips := Addresses(backends)
+		if reflect.DeepEqual(ips, []string{"10.1.0.9"}) {
+			break
+		}
+		select {
+		case <-changes:
+		case <-deadline:
+			t.Fatalf("watch: Expected [10.1.0.9] - Got %v", ips)
+		}
+	}
+}
+
+func TestKubernetesProviderUnauthorized(t *testing.T) {
+	_, kubeconfig, cleanup := newTestAPIServer(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testEndpoints)
+	})
+	defer cleanup()
+
+	k8sService := KubernetesProvider{
+		Kubeconfig:  kubeconfig,
+		ServiceName: "varnish",
+	}
+	expect(t, "auth", k8sService.Auth(), nil)
+	k8sService.token = "wrong"
+	backends, err := k8sService.Backends(context.Background())
+	expect(t, "unauthorized", err != nil, true)
+	expect(t, "unauthorized", len(backends), 0)
+}
@@ -0,0 +1,171 @@
+package providers
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Source is a named service contributing backends to a MultiProvider
+type Source struct {
+	Name    string
+	Service Service
+}
+
+// SourceStatus reports the backends last returned by a source and the
+// error of its latest lookup, if it failed
+type SourceStatus struct {
+	Name     string    `json:"name"`
+	Backends []Backend `json:"backends"`
+	Updated  time.Time `json:"updated"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// MultiProvider merges the backends of several services into one list
+type MultiProvider struct {
+	Sources []Source
+	Debug   bool
+
+	mu     sync.Mutex
+	status map[string]SourceStatus
+}
+
+// Auth authenticates every source, failing on the first error
+func (m *MultiProvider) Auth() error {
+	for _, s := range m.Sources {
+		if err := s.Service.Auth(); err != nil {
+			return fmt.Errorf("%s: %v", s.Name, err)
+		}
+	}
+	return nil
+}
+
+// Backends queries every source concurrently and returns the de-duplicated
+// union of their backends in source order. A source that fails contributes
+// the backends it last returned, an error is only returned when every
+// source fails.
+func (m *MultiProvider) Backends(ctx context.Context) ([]Backend, error) {
+	results := make([][]Backend, len(m.Sources))
+	errs := make([]error, len(m.Sources))
+	var wg sync.WaitGroup
+	wg.Add(len(m.Sources))
+	for i, s := range m.Sources {
+		go func(i int, s Source) {
+			defer wg.Done()
+			results[i], errs[i] = s.Service.Backends(ctx)
+		}(i, s)
+	}
+	wg.Wait()
+
+	now := time.Now()
+	seen := map[string]bool{}
+	instances := []Backend{}
+	failed := []string{}
+	m.mu.Lock()
+	if m.status == nil {
+		m.status = map[string]SourceStatus{}
+	}
+	for i, s := range m.Sources {
+		st := m.status[s.Name]
+		st.Name = s.Name
+		if errs[i] != nil {
+			log.Printf("Source %s failed, keeping its previous %d backends: %v\n", s.Name, len(st.Backends), errs[i])
+			st.Error = errs[i].Error()
+			if st.Backends == nil {
+				st.Backends = []Backend{}
+			}
+			failed = append(failed, fmt.Sprintf("%s: %v", s.Name, errs[i]))
+		} else {
+			if len(m.Sources) > 1 {
+				log.Printf("Source %s returned %d backends: %v\n", s.Name, len(results[i]), Addresses(results[i]))
+			}
+			st = SourceStatus{Name: s.Name, Backends: results[i], Updated: now}
+		}
+		m.status[s.Name] = st
+		for _, b := range st.Backends {
+			if seen[b.String()] {
+				if m.Debug {
+					log.Printf("Skipping duplicate backend %s from %s\n", b, s.Name)
+				}
+				continue
+			}
+			seen[b.String()] = true
+			instances = append(instances, b)
+		}
+	}
+	m.mu.Unlock()
+
+	if len(failed) > 0 && len(failed) == len(m.Sources) {
+		return nil, errors.New(strings.Join(failed, "; "))
+	}
+	return instances, nil
+}
+
+// Watching reports whether every source is keeping its backends up to date
+// in the background
+func (m *MultiProvider) Watching() bool {
+	for _, s := range m.Sources {
+		w, ok := s.Service.(Watcher)
+		if !ok || !w.Watching() {
+			return false
+		}
+	}
+	return len(m.Sources) > 0
+}
+
+// Notify sets a function to call each time a source watching for changes
+// sees one
+func (m *MultiProvider) Notify(f func()) {
+	for _, s := range m.Sources {
+		if w, ok := s.Service.(Watcher); ok {
+			w.Notify(f)
+		}
+	}
+}
+
+// Status returns the backends last returned by each source in source order
+func (m *MultiProvider) Status() []SourceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := []SourceStatus{}
+	for _, s := range m.Sources {
+		st, ok := m.status[s.Name]
+		if !ok {
+			st = SourceStatus{Name: s.Name, Backends: []Backend{}}
+		}
+		status = append(status, st)
+	}
+	return status
+}
+
+// Stop stops every source running background work
+func (m *MultiProvider) Stop() {
+	for _, s := range m.Sources {
+		if stopper, ok := s.Service.(Stopper); ok {
+			stopper.Stop()
+		}
+	}
+}
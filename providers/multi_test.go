@@ -0,0 +1,117 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+type fakeService struct {
+	backends []Backend
+	err      error
+	watching bool
+	onChange func()
+}
+
+func (f *fakeService) Auth() error {
+	return nil
+}
+
+func (f *fakeService) Backends(ctx context.Context) ([]Backend, error) {
+	return f.backends, f.err
+}
+
+func (f *fakeService) Watching() bool {
+	return f.watching
+}
+
+func (f *fakeService) Notify(onChange func()) {
+	f.onChange = onChange
+}
+
+func TestMultiProvider(t *testing.T) {
+	multi := MultiProvider{
+		Sources: []Source{
+			{"aws", &fakeService{backends: []Backend{{Address: "10.0.0.1"}, {Address: "10.0.0.2"}}}},
+			{"static", &fakeService{backends: []Backend{{Address: "10.0.0.2"}, {Address: "10.0.0.3", Port: 6081}}}},
+			{"empty", &fakeService{backends: []Backend{}}},
+		},
+	}
+	expect(t, "auth", multi.Auth(), nil)
+
+	status := multi.Status()
+	expect(t, "statusbefore", len(status), 3)
+	expect(t, "statusbefore", len(status[0].Backends), 0)
+
+	expected := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3:6081"}
+	backends, err := multi.Backends(context.Background())
+	expect(t, "merged", err, nil)
+	if ips := Addresses(backends); !reflect.DeepEqual(ips, expected) {
+		t.Fatalf("merged: Expected %v - Got %v", expected, ips)
+	}
+
+	status = multi.Status()
+	expect(t, "status", status[1].Name, "static")
+	if !reflect.DeepEqual(Addresses(status[1].Backends), []string{"10.0.0.2", "10.0.0.3:6081"}) {
+		t.Fatalf("status: Got %v", status[1].Backends)
+	}
+	expect(t, "status", status[1].Updated.IsZero(), false)
+}
+
+func TestMultiProviderErrors(t *testing.T) {
+	aws := &fakeService{backends: []Backend{{Address: "10.0.0.1"}}}
+	static := &fakeService{backends: []Backend{{Address: "10.0.0.2"}}}
+	multi := MultiProvider{Sources: []Source{{"aws", aws}, {"static", static}}}
+	multi.Backends(context.Background())
+
+	// A failing source keeps its previous backends
+	aws.err = errors.New("throttled")
+	static.backends = []Backend{{Address: "10.0.0.3"}}
+	backends, err := multi.Backends(context.Background())
+	expect(t, "onefailed", err, nil)
+	if ips := Addresses(backends); !reflect.DeepEqual(ips, []string{"10.0.0.1", "10.0.0.3"}) {
+		t.Fatalf("onefailed: Got %v", ips)
+	}
+	status := multi.Status()
+	expect(t, "onefailed", status[0].Error, "throttled")
+	expect(t, "onefailed", status[1].Error, "")
+
+	static.err = errors.New("unreadable")
+	_, err = multi.Backends(context.Background())
+	expect(t, "allfailed", err.Error(), "aws: throttled; static: unreadable")
+}
+
+func TestMultiProviderWatching(t *testing.T) {
+	watching := &fakeService{watching: true}
+	notWatching := &fakeService{}
+
+	expect(t, "none", (&MultiProvider{}).Watching(), false)
+	expect(t, "all", (&MultiProvider{Sources: []Source{{"a", watching}, {"b", watching}}}).Watching(), true)
+	expect(t, "some", (&MultiProvider{Sources: []Source{{"a", watching}, {"b", notWatching}}}).Watching(), false)
+
+	changes := 0
+	(&MultiProvider{Sources: []Source{{"a", watching}, {"b", notWatching}}}).Notify(func() { changes++ })
+	watching.onChange()
+	notWatching.onChange()
+	expect(t, "notified", changes, 2)
+}
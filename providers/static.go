@@ -0,0 +1,207 @@
+package providers
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// StaticProvider struct
+type StaticProvider struct {
+	File  string
+	Debug bool
+
+	mu       sync.Mutex
+	backends []Backend
+	modTime  time.Time
+	size     int64
+}
+
+// staticBackend is a single entry in a YAML or JSON backends file, either
+// written as a "host[:port]" string or as a {host, port} mapping.
+type staticBackend struct {
+	Host string `json:"host" yaml:"host"`
+	Port int    `json:"port" yaml:"port"`
+}
+
+// Auth loads the backends file, failing if it cannot be read or parsed
+func (s *StaticProvider) Auth() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load()
+}
+
+// Backends returns the backends listed in the file. The file is only
+// re-read when its size or modification time differ from the last load
+func (s *StaticProvider) Backends(ctx context.Context) ([]Backend, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, err := os.Stat(s.File)
+	if err != nil {
+		log.Printf("Unable to stat %s, keeping previous backends: %v\n", s.File, err)
+	} else if !info.ModTime().Equal(s.modTime) || info.Size() != s.size {
+		if err := s.load(); err != nil {
+			log.Printf("Unable to reload %s, keeping previous backends: %v\n", s.File, err)
+		} else {
+			log.Printf("Reloaded %s\n", s.File)
+		}
+	}
+
+	instances := make([]Backend, len(s.backends))
+	copy(instances, s.backends)
+	return instances, nil
+}
+
+// load reads and parses the backends file, it must be called with mu held
+func (s *StaticProvider) load() error {
+	info, err := os.Stat(s.File)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(s.File)
+	if err != nil {
+		return err
+	}
+
+	backends, err := parseStaticBackends(s.File, data)
+	if err != nil {
+		return err
+	}
+	if s.Debug {
+		for _, b := range backends {
+			log.Printf("Adding %s to IP list\n", b)
+		}
+	}
+
+	s.backends = backends
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	return nil
+}
+
+// parseStaticBackends parses data according to the extension of filename,
+// .yaml/.yml and .json files hold a list of backends, anything else is
+// treated as plain text with one backend per line.
+func parseStaticBackends(filename string, data []byte) ([]Backend, error) {
+	var entries []staticBackend
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &entries); err != nil {
+			return nil, err
+		}
+	case ".json":
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, err
+		}
+	default:
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			b, err := parseHostPort(line)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, b)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	backends := []Backend{}
+	for _, b := range entries {
+		if b.Host == "" {
+			return nil, fmt.Errorf("backend with empty host in %s", filename)
+		}
+		if b.Port < 0 || b.Port > 65535 {
+			return nil, fmt.Errorf("invalid port %d for backend %s", b.Port, b.Host)
+		}
+		backends = append(backends, Backend{Address: b.Host, Port: b.Port})
+	}
+	return backends, nil
+}
+
+// parseHostPort splits a "host[:port]" string, bare IPv6 addresses are
+// accepted without a port
+func parseHostPort(s string) (staticBackend, error) {
+	host, strport, err := net.SplitHostPort(s)
+	if err != nil {
+		// No port given
+		return staticBackend{Host: strings.Trim(s, "[]")}, nil
+	}
+	port, err := strconv.Atoi(strport)
+	if err != nil {
+		return staticBackend{}, fmt.Errorf("invalid port in %s", s)
+	}
+	return staticBackend{Host: host, Port: port}, nil
+}
+
+// UnmarshalJSON accepts either a "host[:port]" string or a {host, port} object
+func (b *staticBackend) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		parsed, err := parseHostPort(s)
+		if err != nil {
+			return err
+		}
+		*b = parsed
+		return nil
+	}
+	type plain staticBackend
+	return json.Unmarshal(data, (*plain)(b))
+}
+
+// UnmarshalYAML accepts either a "host[:port]" string or a {host, port} mapping
+func (b *staticBackend) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		parsed, err := parseHostPort(s)
+		if err != nil {
+			return err
+		}
+		*b = parsed
+		return nil
+	}
+	type plain staticBackend
+	return unmarshal((*plain)(b))
+}
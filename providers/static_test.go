@@ -0,0 +1,112 @@
+package providers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+func TestParseStaticBackends(t *testing.T) {
+	expected := []string{"10.0.0.1", "10.0.0.2:6081", "varnish.internal", "[::1]:8080"}
+
+	cases := map[string]struct {
+		filename string
+		data     string
+	}{
+		"yaml": {"backends.yaml", "- 10.0.0.1\n- host: 10.0.0.2\n  port: 6081\n- varnish.internal\n- \"[::1]:8080\"\n"},
+		"json": {"backends.json", `["10.0.0.1", {"host": "10.0.0.2", "port": 6081}, "varnish.internal", {"host": "::1", "port": 8080}]`},
+		"text": {"backends", "# varnish servers\n10.0.0.1\n\n10.0.0.2:6081  # with port\nvarnish.internal\n[::1]:8080\n"},
+	}
+
+	for k, tc := range cases {
+		backends, err := parseStaticBackends(tc.filename, []byte(tc.data))
+		if err != nil {
+			t.Fatalf("%s: %v", k, err)
+		}
+		if !reflect.DeepEqual(Addresses(backends), expected) {
+			t.Fatalf("%s: Expected %v - Got %v", k, expected, backends)
+		}
+	}
+}
+
+func TestParseStaticBackendsInvalid(t *testing.T) {
+	cases := map[string]struct {
+		filename string
+		data     string
+	}{
+		"yamlsyntax": {"backends.yml", "- [10.0.0.1\n"},
+		"jsonsyntax": {"backends.json", `["10.0.0.1"`},
+		"emptyhost":  {"backends.json", `[{"port": 80}]`},
+		"badport":    {"backends", "10.0.0.1:http\n"},
+		"portrange":  {"backends.yaml", "- host: 10.0.0.1\n  port: 70000\n"},
+	}
+
+	for k, tc := range cases {
+		_, err := parseStaticBackends(tc.filename, []byte(tc.data))
+		if err == nil {
+			t.Fatalf("%s: expected error", k)
+		}
+	}
+}
+
+func TestStaticProviderReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "backends.txt")
+
+	if err := ioutil.WriteFile(file, []byte("10.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	staticService := StaticProvider{File: file}
+	expect(t, "auth", staticService.Auth(), nil)
+	count := func() int {
+		backends, err := staticService.Backends(context.Background())
+		expect(t, "backends", err, nil)
+		return len(backends)
+	}
+	expect(t, "initial", count(), 1)
+
+	if err := ioutil.WriteFile(file, []byte("10.0.0.1\n10.0.0.2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(file, future, future)
+	expect(t, "reloaded", count(), 2)
+
+	// A broken file keeps the last good list
+	if err := ioutil.WriteFile(file, []byte("10.0.0.1:bad\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	future = future.Add(time.Minute)
+	os.Chtimes(file, future, future)
+	expect(t, "broken", count(), 2)
+
+	os.Remove(file)
+	expect(t, "removed", count(), 2)
+}
@@ -0,0 +1,158 @@
+package main
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultPurgeLimit is the most purges listed by /purges unless a limit is
+// given
+const defaultPurgeLimit = 100
+
+// jobStatus is the delivery state of a queued purge as returned by /purges
+type jobStatus struct {
+	ID       string          `json:"id"`
+	State    string          `json:"state"`
+	Received time.Time       `json:"received"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Host     string          `json:"host"`
+	Backends []backendStatus `json:"backends"`
+	Error    string          `json:"error,omitempty"`
+	// Deliveries counts the times the purge was sent to the backends
+	// still pending, the next is due at NextDelivery
+	Deliveries   int        `json:"deliveries"`
+	NextDelivery *time.Time `json:"next_delivery,omitempty"`
+}
+
+// backendStatus is the delivery state of a queued purge to one backend
+type backendStatus struct {
+	jobDelivery
+	RetriesLeft int `json:"retries_left"`
+}
+
+// newJobStatus returns the status of job, maxDeliveries is the most times
+// it is delivered unless it was given its own limit when first delivered
+func newJobStatus(job *purgeJob, maxDeliveries int) jobStatus {
+	status := jobStatus{
+		ID:         job.ID,
+		State:      job.State,
+		Received:   job.Received,
+		Method:     job.Method,
+		URL:        job.URL,
+		Host:       job.Host,
+		Backends:   []backendStatus{},
+		Error:      job.Error,
+		Deliveries: job.Deliveries,
+	}
+	if job.State == statePending && !job.NextDelivery.IsZero() {
+		next := job.NextDelivery
+		status.NextDelivery = &next
+	}
+	if job.MaxDeliveries > 0 {
+		maxDeliveries = job.MaxDeliveries
+	}
+	// Each delivery sends the purge again to every backend still pending
+	left := 0
+	if job.State == statePending && maxDeliveries > job.Deliveries {
+		left = maxDeliveries - job.Deliveries
+	}
+	for _, b := range job.Backends {
+		backend := backendStatus{jobDelivery: b}
+		if b.State == statePending {
+			backend.RetriesLeft = left
+		}
+		status.Backends = append(status.Backends, backend)
+	}
+	return status
+}
+
+// purgesHandler serves GET /purges, optionally filtered by ?state= and
+// limited to the most recent ?limit= purges
+func purgesHandler(w http.ResponseWriter, r *http.Request, state *proxyState) {
+	if !checkPurgesRequest(w, r, state) {
+		return
+	}
+	filter := r.URL.Query().Get("state")
+	switch filter {
+	case "", statePending, stateDelivered, stateFailed:
+	default:
+		http.Error(w, "state must be pending, delivered or failed", 400)
+		return
+	}
+	limit := defaultPurgeLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 {
+			http.Error(w, "limit must be a positive number", 400)
+			return
+		}
+		limit = parsed
+	}
+
+	jobs := purgeJobs.list(filter)
+	if len(jobs) > limit {
+		jobs = jobs[len(jobs)-limit:]
+	}
+	statuses := []jobStatus{}
+	for _, job := range jobs {
+		statuses = append(statuses, newJobStatus(job, state.settings.queueRetry.attempts))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Purges []jobStatus `json:"purges"`
+	}{statuses})
+}
+
+// purgeHandler serves GET /purges/{id}
+func purgeHandler(w http.ResponseWriter, r *http.Request, state *proxyState) {
+	if !checkPurgesRequest(w, r, state) {
+		return
+	}
+	job, ok := purgeJobs.get(strings.TrimPrefix(r.URL.Path, "/purges/"))
+	if !ok {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newJobStatus(job, state.settings.queueRetry.attempts))
+}
+
+// checkPurgesRequest responds with an error unless r is a GET from a known
+// client and the queue is enabled
+func checkPurgesRequest(w http.ResponseWriter, r *http.Request, state *proxyState) bool {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(405), 405)
+		return false
+	}
+	if !authorized(w, r, nil, state) {
+		return false
+	}
+	if purgeJobs == nil {
+		http.Error(w, "purge queue is not enabled, start with --queue-dir", 404)
+		return false
+	}
+	return true
+}
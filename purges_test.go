@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestPurgesHandlers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "purges")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	useBackends(t, settings{retry: retryPolicy{attempts: 3}})
+	handler := newServer(loadState().settings).Handler
+
+	// Without a queue there is nothing to list
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/purges", nil))
+	expect(t, "disabled", w.Code, 404)
+
+	purgeJobs, err = openQueue(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		purgeJobs.close(context.Background())
+		purgeJobs = nil
+	}()
+	purgeJobs.add(&purgeJob{ID: "delivered", State: stateDelivered, Method: "PURGE", URL: "/a",
+		Backends: []jobDelivery{{Backend: "10.0.0.1:80", State: stateDelivered, Status: 200, Attempts: 1}}})
+	purgeJobs.add(&purgeJob{ID: "failed", State: stateFailed, Method: "PURGE", URL: "/b",
+		Backends: []jobDelivery{{Backend: "10.0.0.1:80", State: stateFailed, Status: 503, Attempts: 3, Error: "unexpected status 503"}}})
+	purgeJobs.add(&purgeJob{ID: "pending", State: statePending, Method: "PURGE", URL: "/c", Deliveries: 1, MaxDeliveries: 5,
+		Backends: []jobDelivery{{Backend: "10.0.0.1:80", State: stateDelivered, Attempts: 1}, {Backend: "10.0.0.2:80", State: statePending, Attempts: 3}}})
+
+	cases := map[string]struct {
+		path     string
+		code     int
+		expected []string
+	}{
+		"all":        {"/purges", 200, []string{"delivered", "failed", "pending"}},
+		"failed":     {"/purges?state=failed", 200, []string{"failed"}},
+		"limit":      {"/purges?limit=2", 200, []string{"failed", "pending"}},
+		"badstate":   {"/purges?state=lost", 400, nil},
+		"badlimit":   {"/purges?limit=0", 400, nil},
+		"one":        {"/purges/pending", 200, []string{"pending"}},
+		"notfound":   {"/purges/missing", 404, nil},
+		"notallowed": {"/purges/pending", 405, nil},
+	}
+
+	for k, tc := range cases {
+		method := "GET"
+		if k == "notallowed" {
+			method = "POST"
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, tc.path, nil))
+		expect(t, k, w.Code, tc.code)
+		if tc.code != 200 {
+			continue
+		}
+
+		var list struct {
+			Purges []jobStatus `json:"purges"`
+		}
+		if k == "one" {
+			var status jobStatus
+			if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+				t.Fatal(err)
+			}
+			list.Purges = []jobStatus{status}
+		} else if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		expect(t, k, len(list.Purges), len(tc.expected))
+		for i, id := range tc.expected {
+			expect(t, k, list.Purges[i].ID, id)
+		}
+	}
+
+	job, _ := purgeJobs.get("pending")
+	expect(t, "deliveredleft", newJobStatus(job, 3).Backends[0].RetriesLeft, 0)
+	expect(t, "retriesleft", newJobStatus(job, 3).Backends[1].RetriesLeft, 4)
+	job.MaxDeliveries, job.Deliveries = 0, 0
+	expect(t, "undelivered", newJobStatus(job, 3).Backends[1].RetriesLeft, 3)
+	job, _ = purgeJobs.get("failed")
+	expect(t, "noretriesleft", newJobStatus(job, 3).Backends[0].RetriesLeft, 0)
+	expect(t, "backenderror", newJobStatus(job, 3).Backends[0].Error, "unexpected status 503")
+}
+
+func TestPurgeAnyPath(t *testing.T) {
+	useBackends(t, settings{})
+	handler := newServer(loadState().settings).Handler
+
+	for _, path := range []string{"/status", "/purges/abc", "//double"} {
+		req := httptest.NewRequest("PURGE", path, nil)
+		req.Header.Set("X-Purge-Regex", ".*")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		expect(t, path, w.Code, 500)
+		expect(t, path, w.Header().Get("Content-Type"), "application/json")
+	}
+}
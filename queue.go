@@ -0,0 +1,579 @@
+package main
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Purge job and backend delivery states
+const (
+	statePending   = "pending"
+	stateDelivered = "delivered"
+	stateFailed    = "failed"
+)
+
+// queueFile is the name of the write-ahead log inside the queue directory
+const queueFile = "purges.log"
+
+// compactAfter is how many records are written to the log before it is
+// rewritten with only the jobs still held
+const compactAfter = 1000
+
+// purgeJob is a purge accepted in async mode, saved to the queue until it
+// has been delivered to every backend or its deliveries have run out
+type purgeJob struct {
+	ID       string        `json:"id"`
+	State    string        `json:"state"`
+	Received time.Time     `json:"received"`
+	Method   string        `json:"method"`
+	URL      string        `json:"url"`
+	Host     string        `json:"host"`
+	Header   http.Header   `json:"header"`
+	Body     []byte        `json:"body,omitempty"`
+	Backends []jobDelivery `json:"backends"`
+	Error    string        `json:"error,omitempty"`
+
+	// Deliveries counts the times the job was sent to the backends it had
+	// not reached yet. The limits are set on the first delivery and kept
+	// with the job, so a restart doesn't give it a fresh start.
+	Deliveries    int       `json:"deliveries"`
+	MaxDeliveries int       `json:"max_deliveries"`
+	Expires       time.Time `json:"expires"`
+	NextDelivery  time.Time `json:"next_delivery"`
+}
+
+// jobDelivery is the delivery state of a job to one backend
+type jobDelivery struct {
+	Backend  string `json:"backend"`
+	State    string `json:"state"`
+	Status   int    `json:"status,omitempty"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+}
+
+// clone returns a copy of the job that shares nothing with it
+func (j *purgeJob) clone() *purgeJob {
+	c := *j
+	c.Header = j.Header.Clone()
+	c.Backends = append([]jobDelivery(nil), j.Backends...)
+	return &c
+}
+
+// request returns the purge as it was received
+func (j *purgeJob) request() (*http.Request, error) {
+	r, err := http.NewRequest(j.Method, j.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.Header = j.Header.Clone()
+	r.Host = j.Host
+	return r, nil
+}
+
+// newPurgeJob returns a pending job for the purge r with body
+func newPurgeJob(r *http.Request, body []byte) (*purgeJob, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	return &purgeJob{
+		ID:       id,
+		State:    statePending,
+		Received: time.Now().UTC(),
+		Method:   r.Method,
+		URL:      r.URL.String(),
+		Host:     r.Host,
+		Header:   r.Header.Clone(),
+		Body:     body,
+	}, nil
+}
+
+// newJobID returns a random purge ID
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// purgeQueue holds async purges in memory and in a write-ahead log on disk,
+// so that jobs not yet delivered are picked up again after a restart. Every
+// change to a job appends the whole job to the log, the last record for an
+// ID wins when the log is read back.
+type purgeQueue struct {
+	dir    string
+	retain int
+
+	mu      sync.Mutex
+	wake    *sync.Cond
+	file    *os.File
+	records int
+	jobs    map[string]*purgeJob
+	order   []string
+	waiting []string
+	// delayed holds the timers of jobs waiting to be delivered again
+	delayed map[string]*time.Timer
+	closed  bool
+	workers sync.WaitGroup
+}
+
+// openQueue reads the log in dir, creating it if needed. Up to retain
+// finished jobs are kept for their status to be looked up.
+func openQueue(dir string, retain int) (*purgeQueue, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	q := &purgeQueue{dir: dir, retain: retain, jobs: map[string]*purgeJob{}, delayed: map[string]*time.Timer{}}
+	q.wake = sync.NewCond(&q.mu)
+
+	f, err := os.Open(filepath.Join(dir, queueFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			job := &purgeJob{}
+			if err := json.Unmarshal(scanner.Bytes(), job); err != nil || job.ID == "" {
+				// A crash can leave the last record half written
+				log.Printf("Skipping unreadable record %d in %s\n", line, f.Name())
+				continue
+			}
+			if _, ok := q.jobs[job.ID]; !ok {
+				q.order = append(q.order, job.ID)
+			}
+			q.jobs[job.ID] = job
+		}
+		err := scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, id := range q.order {
+		if job := q.jobs[id]; job.State == statePending {
+			q.schedule(id, job.NextDelivery)
+		}
+	}
+	if resumed := len(q.waiting) + len(q.delayed); resumed > 0 {
+		log.Printf("Resuming %d queued purges\n", resumed)
+	}
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// compact rewrites the log with the jobs currently held, dropping the oldest
+// finished jobs beyond retain. q.mu must be held, or q not yet shared.
+func (q *purgeQueue) compact() error {
+	finished := 0
+	for _, id := range q.order {
+		if q.jobs[id].State != statePending {
+			finished++
+		}
+	}
+	order := []string{}
+	for _, id := range q.order {
+		if q.jobs[id].State != statePending && finished > q.retain {
+			delete(q.jobs, id)
+			finished--
+			continue
+		}
+		order = append(order, id)
+	}
+	q.order = order
+
+	path := filepath.Join(q.dir, queueFile)
+	tmp, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(w)
+	for _, id := range q.order {
+		if err := encoder.Encode(q.jobs[id]); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	if q.file != nil {
+		q.file.Close()
+	}
+	q.file, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0640)
+	q.records = 0
+	return err
+}
+
+// write appends job to the log and syncs it to disk. q.mu must be held.
+func (q *purgeQueue) write(job *purgeJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	if _, err := q.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := q.file.Sync(); err != nil {
+		return err
+	}
+	q.records++
+	if q.records >= compactAfter && q.records >= 2*len(q.jobs) {
+		if err := q.compact(); err != nil {
+			log.Printf("Failed to compact purge queue: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// add saves a new job and queues it for delivery, it is only queued once it
+// is safely on disk
+func (q *purgeQueue) add(job *purgeJob) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return fmt.Errorf("purge queue is closed")
+	}
+	job = job.clone()
+	if err := q.write(job); err != nil {
+		return err
+	}
+	q.jobs[job.ID] = job
+	q.order = append(q.order, job.ID)
+	q.waiting = append(q.waiting, job.ID)
+	q.wake.Signal()
+	return nil
+}
+
+// update saves the latest state of a job
+func (q *purgeQueue) update(job *purgeJob) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job = job.clone()
+	q.jobs[job.ID] = job
+	return q.write(job)
+}
+
+// redeliver queues a job again once its next delivery is due
+func (q *purgeQueue) redeliver(job *purgeJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.schedule(job.ID, job.NextDelivery)
+	}
+}
+
+// schedule queues the job with the given ID at the time given, straight
+// away if that has passed. q.mu must be held.
+func (q *purgeQueue) schedule(id string, at time.Time) {
+	delay := time.Until(at)
+	if delay <= 0 {
+		q.waiting = append(q.waiting, id)
+		q.wake.Signal()
+		return
+	}
+	q.delayed[id] = time.AfterFunc(delay, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		delete(q.delayed, id)
+		if !q.closed {
+			q.waiting = append(q.waiting, id)
+			q.wake.Signal()
+		}
+	})
+}
+
+// get returns a copy of the job with the given ID
+func (q *purgeQueue) get(id string) (*purgeJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return nil, false
+	}
+	return job.clone(), true
+}
+
+// list returns copies of the jobs in the given state, or all jobs if state
+// is empty, in the order they were received
+func (q *purgeQueue) list(state string) []*purgeJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := []*purgeJob{}
+	for _, id := range q.order {
+		if job := q.jobs[id]; state == "" || job.State == state {
+			jobs = append(jobs, job.clone())
+		}
+	}
+	return jobs
+}
+
+// queueStatus summarises the jobs held by the queue
+type queueStatus struct {
+	Depth     int `json:"depth"`
+	Delayed   int `json:"delayed"`
+	Pending   int `json:"pending"`
+	Delivered int `json:"delivered"`
+	Failed    int `json:"failed"`
+}
+
+// status returns the number of jobs waiting for a worker, the number
+// waiting to be delivered again and the number in each state
+func (q *purgeQueue) status() queueStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	status := queueStatus{Depth: len(q.waiting), Delayed: len(q.delayed)}
+	for _, job := range q.jobs {
+		switch job.State {
+		case statePending:
+			status.Pending++
+		case stateDelivered:
+			status.Delivered++
+		case stateFailed:
+			status.Failed++
+		}
+	}
+	return status
+}
+
+// next waits for a job to deliver, returning false once the queue is closed
+func (q *purgeQueue) next() (*purgeJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.waiting) == 0 && !q.closed {
+		q.wake.Wait()
+	}
+	if q.closed {
+		return nil, false
+	}
+	id := q.waiting[0]
+	q.waiting = q.waiting[1:]
+	return q.jobs[id].clone(), true
+}
+
+// start runs workers delivering jobs with deliver
+func (q *purgeQueue) start(workers int, deliver func(*purgeJob)) {
+	q.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer q.workers.Done()
+			for {
+				job, ok := q.next()
+				if !ok {
+					return
+				}
+				deliver(job)
+			}
+		}()
+	}
+}
+
+// close stops the workers taking new jobs and waits until ctx is done for
+// those being delivered, jobs left pending are delivered after a restart
+func (q *purgeQueue) close(ctx context.Context) error {
+	q.mu.Lock()
+	q.closed = true
+	for id, timer := range q.delayed {
+		timer.Stop()
+		delete(q.delayed, id)
+	}
+	q.wake.Broadcast()
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.file.Close()
+}
+
+// queuePurge saves a purge to the queue and responds with its ID
+func queuePurge(w http.ResponseWriter, r *http.Request, body []byte) {
+	job, err := newPurgeJob(r, body)
+	if err != nil {
+		log.Printf("Failed to create purge ID: %v\n", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	id := job.ID
+	if err := purgeJobs.add(job); err != nil {
+		log.Printf("Failed to queue purge: %v\n", err)
+		http.Error(w, http.StatusText(503), 503)
+		return
+	}
+	purgesReceived.inc(r.Method, "queued")
+	if *debug {
+		log.Printf("Queued purge %s for %s\n", id, job.URL)
+	}
+
+	w.Header().Set("Location", "/purges/"+id)
+	if prefersText(r.Header.Get("Accept")) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "%s %s\n", id, statePending)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(struct {
+		ID    string `json:"id"`
+		State string `json:"state"`
+	}{id, statePending})
+}
+
+// deliverJob sends a queued purge to every backend it has not reached yet.
+// Backends are looked up when a job is first delivered and kept with it, so
+// a job resumed after a restart goes to the same backends. Backends that
+// failed stay pending and the job is delivered again after a backoff, until
+// it runs out of deliveries or expires.
+func deliverJob(q *purgeQueue, job *purgeJob) {
+	state := loadState()
+	state.requests.RLock()
+	defer state.requests.RUnlock()
+
+	if job.MaxDeliveries == 0 {
+		job.MaxDeliveries = state.settings.queueRetry.attempts
+		if job.MaxDeliveries < 1 {
+			job.MaxDeliveries = 1
+		}
+		if state.settings.queueMaxAge > 0 {
+			job.Expires = job.Received.Add(state.settings.queueMaxAge)
+		}
+	}
+	job.Deliveries++
+	job.Error = ""
+
+	// A job that found no backends looks them up again when redelivered
+	if len(job.Backends) == 0 {
+		job.Backends = []jobDelivery{}
+		for _, ip := range registry.backends() {
+			job.Backends = append(job.Backends, jobDelivery{Backend: state.settings.deliveryAddr(ip), State: statePending})
+		}
+		if err := q.update(job); err != nil {
+			log.Printf("Failed to save purge %s: %v\n", job.ID, err)
+		}
+	}
+
+	pending := []string{}
+	for _, b := range job.Backends {
+		if b.State == statePending {
+			pending = append(pending, b.Backend)
+		}
+	}
+
+	results := []backendResult{}
+	r, err := job.request()
+	switch {
+	case len(job.Backends) == 0:
+		job.Error = "no backends found"
+	case err != nil:
+		// The purge can never be sent, so there is no point trying again
+		job.Error = err.Error()
+		job.MaxDeliveries = job.Deliveries
+	default:
+		ctx, cancel := context.WithTimeout(context.Background(), state.settings.purgeTimeout)
+		results = fanOut(ctx, r, job.Body, pending, state)
+		cancel()
+	}
+
+	byBackend := map[string]backendResult{}
+	for _, result := range results {
+		byBackend[result.Backend] = result
+	}
+	job.State = stateDelivered
+	if len(job.Backends) == 0 || job.Error != "" {
+		job.State = statePending
+	}
+	for i := range job.Backends {
+		b := &job.Backends[i]
+		if result, ok := byBackend[b.Backend]; ok {
+			b.Status = result.Status
+			b.Attempts += result.Attempts
+			b.Error = result.Error
+			if !result.failed() {
+				b.State = stateDelivered
+			}
+		}
+		if b.State != stateDelivered {
+			job.State = statePending
+		}
+	}
+
+	if job.State == statePending {
+		now := time.Now().UTC()
+		if job.Deliveries >= job.MaxDeliveries || (!job.Expires.IsZero() && !now.Before(job.Expires)) {
+			log.Printf("Purge %s failed on some backends after %d deliveries\n", job.ID, job.Deliveries)
+			job.State = stateFailed
+			for i := range job.Backends {
+				if job.Backends[i].State == statePending {
+					job.Backends[i].State = stateFailed
+				}
+			}
+		} else {
+			job.NextDelivery = now.Add(state.settings.queueRetry.delay(job.Deliveries))
+			if *debug {
+				log.Printf("Delivering purge %s again at %v\n", job.ID, job.NextDelivery)
+			}
+		}
+	}
+	if err := q.update(job); err != nil {
+		log.Printf("Failed to save purge %s: %v\n", job.ID, err)
+	}
+	if job.State == statePending {
+		q.redeliver(job)
+	}
+}
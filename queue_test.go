@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := openQueue(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if err := q.add(&purgeJob{ID: id, State: statePending, Method: "PURGE", URL: "/" + id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	job, _ := q.next()
+	expect(t, "first", job.ID, "a")
+	job.State = stateDelivered
+	job.Backends = []jobDelivery{{Backend: "10.0.0.1:80", State: stateDelivered, Attempts: 1}}
+	if err := q.update(job); err != nil {
+		t.Fatal(err)
+	}
+	job, _ = q.next()
+	expect(t, "second", job.ID, "b")
+	job.Backends = []jobDelivery{{Backend: "10.0.0.1:80", State: stateDelivered, Attempts: 1}, {Backend: "10.0.0.2:80", State: statePending}}
+	if err := q.update(job); err != nil {
+		t.Fatal(err)
+	}
+	q.file.Close()
+
+	// A crash while writing leaves half a record
+	f, err := os.OpenFile(filepath.Join(dir, queueFile), os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":"d","sta`)
+	f.Close()
+
+	q, err = openQueue(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, "status", q.status(), queueStatus{Depth: 2, Pending: 2, Delivered: 1})
+	job, _ = q.next()
+	expect(t, "resumed", job.ID, "b")
+	expect(t, "resumedbackends", len(job.Backends), 2)
+	expect(t, "resumeddelivered", job.Backends[0].State, stateDelivered)
+	job, _ = q.next()
+	expect(t, "resumednext", job.ID, "c")
+	delivered, ok := q.get("a")
+	expect(t, "delivered", ok && delivered.State == stateDelivered, true)
+	_, ok = q.get("d")
+	expect(t, "torn", ok, false)
+	q.close(context.Background())
+}
+
+func TestQueueRetain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := openQueue(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		q.add(&purgeJob{ID: id, State: statePending})
+	}
+	for i := 0; i < 2; i++ {
+		job, _ := q.next()
+		job.State = stateFailed
+		q.update(job)
+	}
+	q.close(context.Background())
+
+	q, err = openQueue(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.close(context.Background())
+	_, ok := q.get("a")
+	expect(t, "oldest", ok, false)
+	_, ok = q.get("b")
+	expect(t, "retained", ok, true)
+	_, ok = q.get("c")
+	expect(t, "pending", ok, true)
+}
+
+func TestQueuePurge(t *testing.T) {
+	var mu sync.Mutex
+	received := []string{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received = append(received, r.Method+" "+r.URL.Path+" "+r.Header.Get("X-Purge-Regex"))
+		mu.Unlock()
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	useBackends(t, settings{}, backendURL.Host, "127.0.0.1:1")
+	purgeJobs, err = openQueue(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { purgeJobs = nil }()
+
+	req := httptest.NewRequest("PURGE", "/page", nil)
+	req.Header.Set("X-Purge-Regex", ".*")
+	w := httptest.NewRecorder()
+	requestHandler(w, req, loadState())
+	expect(t, "status", w.Code, 202)
+	var accepted struct {
+		ID    string `json:"id"`
+		State string `json:"state"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&accepted); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, "state", accepted.State, statePending)
+	expect(t, "location", w.Header().Get("Location"), "/purges/"+accepted.ID)
+	expect(t, "depth", purgeJobs.status().Depth, 1)
+
+	purgeJobs.start(1, func(job *purgeJob) {
+		deliverJob(purgeJobs, job)
+	})
+	for i := 0; i < 500; i++ {
+		if job, _ := purgeJobs.get(accepted.ID); job.State != statePending {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := purgeJobs.close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	job, ok := purgeJobs.get(accepted.ID)
+	expect(t, "found", ok, true)
+	expect(t, "jobstate", job.State, stateFailed)
+	expect(t, "backends", len(job.Backends), 2)
+	expect(t, "delivered", job.Backends[0].State, stateDelivered)
+	expect(t, "deliveredstatus", job.Backends[0].Status, 200)
+	expect(t, "failed", job.Backends[1].State, stateFailed)
+	mu.Lock()
+	defer mu.Unlock()
+	expect(t, "received", len(received), 1)
+	expect(t, "request", received[0], "PURGE /page .*")
+}
+
+func TestQueuePurgeNoBackends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	useBackends(t, settings{})
+	q, err := openQueue(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.close(context.Background())
+
+	q.add(&purgeJob{ID: "a", State: statePending, Method: "PURGE", URL: "/"})
+	job, _ := q.next()
+	deliverJob(q, job)
+	job, _ = q.get("a")
+	expect(t, "state", job.State, stateFailed)
+	expect(t, "error", job.Error, "no backends found")
+	expect(t, "backends", len(job.Backends), 0)
+}
+
+func TestQueueRedelivery(t *testing.T) {
+	var mu sync.Mutex
+	received := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		// Unavailable for the first two deliveries, as during a restart
+		received++
+		if received <= 2 {
+			w.WriteHeader(503)
+		}
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	useBackends(t, settings{queueRetry: retryPolicy{attempts: 3, backoff: 10 * time.Millisecond, maxBackoff: 10 * time.Millisecond}, queueMaxAge: time.Hour}, backendURL.Host)
+	q, err := openQueue(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.add(&purgeJob{ID: "a", State: statePending, Received: time.Now(), Method: "PURGE", URL: "/"})
+	q.add(&purgeJob{ID: "b", State: statePending, Received: time.Now(), Method: "PURGE", URL: "/"})
+
+	// The first job is only delivered once, and saved to be delivered again
+	job, _ := q.next()
+	deliverJob(q, job)
+	job, _ = q.get("a")
+	expect(t, "pending", job.State, statePending)
+	expect(t, "backendpending", job.Backends[0].State, statePending)
+	expect(t, "backendstatus", job.Backends[0].Status, 503)
+	expect(t, "deliveries", job.Deliveries, 1)
+	expect(t, "maxdeliveries", job.MaxDeliveries, 3)
+	q.close(context.Background())
+
+	// After a restart both jobs are delivered, and the first one keeps
+	// count of its deliveries
+	q, err = openQueue(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.start(1, func(job *purgeJob) {
+		deliverJob(q, job)
+	})
+	for i := 0; i < 500; i++ {
+		a, _ := q.get("a")
+		b, _ := q.get("b")
+		if a.State != statePending && b.State != statePending {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := q.close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	job, _ = q.get("a")
+	expect(t, "delivered", job.State, stateDelivered)
+	expect(t, "backenddelivered", job.Backends[0].State, stateDelivered)
+	expect(t, "attempts", job.Backends[0].Attempts, job.Deliveries)
+	job, _ = q.get("b")
+	expect(t, "alsodelivered", job.State, stateDelivered)
+	a, _ := q.get("a")
+	expect(t, "totaldeliveries", a.Deliveries+job.Deliveries, 4)
+}
@@ -0,0 +1,303 @@
+package main
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BashtonLtd/varnish-purge-proxy/providers"
+)
+
+// settings holds the global settings, from flags and the config file
+type settings struct {
+	listen          string
+	port            int
+	cache           int
+	destport        int
+	debug           bool
+	timeout         time.Duration
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
+	shutdownTimeout time.Duration
+	partialStatus   int
+	failureStatus   int
+	acceptStatus    map[string][]int
+	successBody     string
+	purgeTimeout    time.Duration
+	coalesceWindow  time.Duration
+	retry           retryPolicy
+	queueDir        string
+	queueWorkers    int
+	queueRetain     int
+	queueRetry      retryPolicy
+	queueMaxAge     time.Duration
+	readyMaxAge     time.Duration
+	transport       string
+	cliPort         int
+	cliSecret       string
+	authTokens      string
+	authKeys        string
+	authMaxSkew     time.Duration
+}
+
+// flagSettings returns the settings given by the global flags
+func flagSettings() (settings, error) {
+	statuses, err := parseAcceptStatus(*acceptStatus)
+	if err != nil {
+		return settings{}, err
+	}
+	retryStatuses, err := parseStatusList(*retryStatus)
+	if err != nil {
+		return settings{}, fmt.Errorf("invalid --retry-status: %v", err)
+	}
+	retryErrors, err := parseErrorClasses(*retryError)
+	if err != nil {
+		return settings{}, fmt.Errorf("invalid --retry-error: %v", err)
+	}
+	return settings{
+		listen:          *listen,
+		port:            *port,
+		cache:           *cache,
+		destport:        *destport,
+		debug:           *debug,
+		timeout:         *timeout,
+		readTimeout:     *readTimeout,
+		writeTimeout:    *writeTimeout,
+		shutdownTimeout: *shutdownTimeout,
+		partialStatus:   *partialStatus,
+		failureStatus:   *failureStatus,
+		acceptStatus:    statuses,
+		successBody:     *successBody,
+		purgeTimeout:    *purgeTimeout,
+		coalesceWindow:  *coalesceWindow,
+		retry: retryPolicy{
+			attempts:   *retries,
+			backoff:    *retryBackoff,
+			maxBackoff: *retryMaxBackoff,
+			jitter:     *retryJitter,
+			statuses:   retryStatuses,
+			errors:     retryErrors,
+		},
+		queueDir:     *queueDir,
+		queueWorkers: *queueWorkers,
+		queueRetain:  *queueRetain,
+		readyMaxAge:  *readyMaxAge,
+		queueMaxAge:  *queueMaxAge,
+		queueRetry: retryPolicy{
+			attempts:   *queueAttempts,
+			backoff:    *queueBackoff,
+			maxBackoff: *queueMaxBackoff,
+		},
+		transport:   *transport,
+		cliPort:     *cliPort,
+		cliSecret:   *cliSecret,
+		authTokens:  *authTokens,
+		authKeys:    *authKeys,
+		authMaxSkew: *authMaxSkew,
+	}, nil
+}
+
+// proxyState is everything a purge request is served with, it is replaced
+// as a whole when the configuration is reloaded so that each request sees
+// either the old or the new configuration, never a mix
+type proxyState struct {
+	settings settings
+	service  providers.Service
+	client   *http.Client
+	success  *successCriteria
+	// cliSecret is the contents of the --cli-secret file
+	cliSecret []byte
+	// auth holds the credentials of purge clients, nil when purges are
+	// accepted from anyone
+	auth *clientAuth
+
+	// requests is read locked by each request using this state, so that
+	// the service is only stopped once they have all finished
+	requests sync.RWMutex
+}
+
+var currentState atomic.Value
+
+// loadState returns the state to serve a request with
+func loadState() *proxyState {
+	return currentState.Load().(*proxyState)
+}
+
+// reloader rebuilds the proxy state from the command line and config file
+type reloader struct {
+	base     settings
+	explicit map[string]bool
+	services []serviceConfig
+}
+
+// load reads the config file, if any, and returns a new state with its
+// services authenticated
+func (rl *reloader) load() (*proxyState, error) {
+	s := rl.base
+	configs := rl.services
+	if *configFile != "" {
+		c, err := loadConfig(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		c.apply(&s, rl.explicit)
+		// Services given on the command line replace those in the file
+		if len(configs) == 0 {
+			configs = c.Services
+		}
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no services given, use a service command or list services in --config")
+	}
+	for name, status := range map[string]int{"partial": s.partialStatus, "failure": s.failureStatus} {
+		if status < 100 || status > 599 {
+			return nil, fmt.Errorf("%s status must be between 100 and 599, got %d", name, status)
+		}
+	}
+	if s.retry.attempts < 1 {
+		return nil, fmt.Errorf("retries must be at least 1, got %d", s.retry.attempts)
+	}
+	if s.queueWorkers < 1 {
+		return nil, fmt.Errorf("queue workers must be at least 1, got %d", s.queueWorkers)
+	}
+	if s.queueRetry.attempts < 1 {
+		return nil, fmt.Errorf("queue attempts must be at least 1, got %d", s.queueRetry.attempts)
+	}
+	if s.coalesceWindow < 0 {
+		return nil, fmt.Errorf("coalesce window must not be negative, got %v", s.coalesceWindow)
+	}
+	// A merged purge is sent up to a window after it arrived, leaving the
+	// rest of the purge timeout for the servers
+	if s.coalesceWindow > 0 && s.coalesceWindow >= s.purgeTimeout {
+		return nil, fmt.Errorf("coalesce window must be shorter than the purge timeout, got %v and %v", s.coalesceWindow, s.purgeTimeout)
+	}
+	if s.authKeys != "" && s.authMaxSkew <= 0 {
+		return nil, fmt.Errorf("auth max skew must be positive, got %v", s.authMaxSkew)
+	}
+	if s.transport != "http" && s.transport != "cli" {
+		return nil, fmt.Errorf("transport must be http or cli, got %q", s.transport)
+	}
+	return newProxyState(s, configs)
+}
+
+// newProxyState creates and authenticates the services in configs
+func newProxyState(s settings, configs []serviceConfig) (*proxyState, error) {
+	success, err := newSuccessCriteria(s.acceptStatus, s.successBody)
+	if err != nil {
+		return nil, err
+	}
+	var secret []byte
+	if s.transport == "cli" && s.cliSecret != "" {
+		secret, err = ioutil.ReadFile(s.cliSecret)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CLI secret: %v", err)
+		}
+	}
+
+	auth, err := newClientAuth(s)
+	if err != nil {
+		return nil, err
+	}
+
+	named := make([]serviceConfig, len(configs))
+	copy(named, configs)
+	nameSources(named)
+
+	sources := &providers.MultiProvider{Debug: s.debug}
+	for _, config := range named {
+		service, err := newService(config, s.debug)
+		if err != nil {
+			sources.Stop()
+			return nil, err
+		}
+		sources.Sources = append(sources.Sources, providers.Source{Name: config.Name, Service: service})
+	}
+
+	return &proxyState{
+		settings: s,
+		service:  sources,
+		client: &http.Client{
+			Timeout: s.timeout,
+		},
+		success:   success,
+		cliSecret: secret,
+		auth:      auth,
+	}, nil
+}
+
+// reload swaps in a new state built from the current config file, keeping
+// the old state if anything fails
+func (rl *reloader) reload() {
+	log.Println("Reloading configuration")
+	old := loadState()
+	state, err := rl.load()
+	if err != nil {
+		log.Printf("Failed to reload configuration, keeping current configuration: %v\n", err)
+		return
+	}
+
+	// The listener and logging are set up once at startup
+	fixed := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"listen", old.settings.listen, state.settings.listen},
+		{"port", old.settings.port, state.settings.port},
+		{"read timeout", old.settings.readTimeout, state.settings.readTimeout},
+		{"write timeout", old.settings.writeTimeout, state.settings.writeTimeout},
+		{"debug", old.settings.debug, state.settings.debug},
+		{"queue dir", old.settings.queueDir, state.settings.queueDir},
+		{"queue workers", old.settings.queueWorkers, state.settings.queueWorkers},
+		{"queue retain", old.settings.queueRetain, state.settings.queueRetain},
+	}
+	for _, f := range fixed {
+		if f.old != f.new {
+			log.Printf("Ignoring change of %s from %v to %v, restart to apply it\n", f.name, f.old, f.new)
+		}
+	}
+	state.settings.listen = old.settings.listen
+	state.settings.port = old.settings.port
+	state.settings.readTimeout = old.settings.readTimeout
+	state.settings.writeTimeout = old.settings.writeTimeout
+	state.settings.debug = old.settings.debug
+	state.settings.queueDir = old.settings.queueDir
+	state.settings.queueWorkers = old.settings.queueWorkers
+	state.settings.queueRetain = old.settings.queueRetain
+
+	currentState.Store(state)
+	// Services may have changed, look up their backends straight away
+	registry.refresh(state)
+	registry.watch(state)
+	log.Println("Configuration reloaded")
+
+	go func() {
+		old.requests.Lock()
+		defer old.requests.Unlock()
+		if stopper, ok := old.service.(providers.Stopper); ok {
+			stopper.Stop()
+		}
+	}()
+}
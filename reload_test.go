@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backends := writeConfig(t, dir, "backends.txt", "10.0.0.1\n")
+	configPath := filepath.Join(dir, "config.yaml")
+	oldConfigFile := *configFile
+	*configFile = configPath
+	defer func() { *configFile = oldConfigFile }()
+
+	writeConfig(t, dir, "config.yaml", "port: 8001\ndestport: 6081\nservices:\n  - type: static\n    file: "+backends+"\n")
+	rl := &reloader{base: settings{port: 8000, destport: 80, partialStatus: 207, failureStatus: 500, retry: retryPolicy{attempts: 1}, queueWorkers: 1, queueRetry: retryPolicy{attempts: 1}, transport: "http"}, explicit: map[string]bool{}}
+	state, err := rl.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentState.Store(state)
+	expect(t, "port", loadState().settings.port, 8001)
+	expect(t, "destport", loadState().settings.destport, 6081)
+
+	writeConfig(t, dir, "config.yaml", "port: 9000\ndestport: 6082\nservices:\n  - type: static\n    file: "+backends+"\n")
+	rl.reload()
+	expect(t, "swapped", loadState() != state, true)
+	expect(t, "portfixed", loadState().settings.port, 8001)
+	expect(t, "destportreloaded", loadState().settings.destport, 6082)
+
+	reloaded := loadState()
+	writeConfig(t, dir, "config.yaml", "destport: 0\n")
+	rl.reload()
+	expect(t, "keptoninvalid", loadState() == reloaded, true)
+}
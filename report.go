@@ -0,0 +1,151 @@
+package main
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// backendResult is the outcome of forwarding a purge to one backend
+type backendResult struct {
+	Backend  string        `json:"backend"`
+	Status   int           `json:"status,omitempty"`
+	Attempts int           `json:"attempts"`
+	Latency  time.Duration `json:"-"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// MarshalJSON writes the latency in milliseconds
+func (b backendResult) MarshalJSON() ([]byte, error) {
+	type result backendResult
+	return json.Marshal(struct {
+		result
+		LatencyMS float64 `json:"latency_ms"`
+	}{result(b), float64(b.Latency) / float64(time.Millisecond)})
+}
+
+func (b backendResult) failed() bool {
+	return b.Error != ""
+}
+
+// purgeReport is the response to a purge request
+type purgeReport struct {
+	Result   string          `json:"result"`
+	Backends []backendResult `json:"backends"`
+}
+
+// resultNoBackends is the result of a purge when no backends were found to
+// send it to
+const resultNoBackends = "no_backends"
+
+// newPurgeReport summarises results and returns the status code to respond
+// with, partialStatus when some backends failed and failureStatus when they
+// all did or there were none
+func newPurgeReport(results []backendResult, partialStatus int, failureStatus int) (purgeReport, int) {
+	if len(results) == 0 {
+		return purgeReport{Result: resultNoBackends, Backends: []backendResult{}}, failureStatus
+	}
+	failed := 0
+	for _, result := range results {
+		if result.failed() {
+			failed++
+		}
+	}
+	report := purgeReport{Backends: results}
+	switch {
+	case failed == 0:
+		report.Result = "ok"
+		return report, http.StatusOK
+	case failed < len(results):
+		report.Result = "partial"
+		return report, partialStatus
+	default:
+		report.Result = "failed"
+		return report, failureStatus
+	}
+}
+
+// writeReport writes the report as JSON, or as plain text when the client
+// prefers it
+func writeReport(w http.ResponseWriter, r *http.Request, report purgeReport, status int) {
+	if prefersText(r.Header.Get("Accept")) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		failed := 0
+		for _, result := range report.Backends {
+			line := fmt.Sprintf("%s %s %v", result.Backend, statusText(result.Status), result.Latency.Round(time.Millisecond))
+			if result.Attempts > 1 {
+				line += fmt.Sprintf(" (%d attempts)", result.Attempts)
+			}
+			if result.failed() {
+				failed++
+				line += " " + result.Error
+			}
+			fmt.Fprintln(w, line)
+		}
+		fmt.Fprintf(w, "%s: %d of %d backends failed\n", report.Result, failed, len(report.Backends))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+func statusText(status int) string {
+	if status == 0 {
+		return "-"
+	}
+	return strconv.Itoa(status)
+}
+
+// prefersText reports whether an Accept header ranks text/plain above JSON,
+// JSON is used when both are equally acceptable
+func prefersText(accept string) bool {
+	textQ, jsonQ := 0.0, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		switch mediaType {
+		case "text/plain", "text/*":
+			if q > textQ {
+				textQ = q
+			}
+		case "application/json", "application/*", "*/*":
+			if q > jsonQ {
+				jsonQ = q
+			}
+		}
+	}
+	return textQ > jsonQ
+}
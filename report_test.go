@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestNewPurgeReport(t *testing.T) {
+	ok := backendResult{Backend: "10.0.0.1:80", Status: 200}
+	failed := backendResult{Backend: "10.0.0.2:80", Error: "connection refused"}
+
+	cases := map[string]struct {
+		results        []backendResult
+		expectedResult string
+		expectedStatus int
+	}{
+		"none":    {[]backendResult{}, "no_backends", 502},
+		"ok":      {[]backendResult{ok, ok}, "ok", 200},
+		"partial": {[]backendResult{ok, failed}, "partial", 207},
+		"failed":  {[]backendResult{failed, failed}, "failed", 502},
+	}
+
+	for k, tc := range cases {
+		report, status := newPurgeReport(tc.results, 207, 502)
+		expect(t, k, report.Result, tc.expectedResult)
+		expect(t, k, status, tc.expectedStatus)
+	}
+}
+
+func TestPrefersText(t *testing.T) {
+	cases := map[string]struct {
+		accept   string
+		expected bool
+	}{
+		"empty":     {"", false},
+		"json":      {"application/json", false},
+		"text":      {"text/plain", true},
+		"wildcard":  {"*/*", false},
+		"both":      {"text/plain, application/json", false},
+		"quality":   {"application/json;q=0.5, text/plain", true},
+		"textany":   {"text/*", true},
+		"curl":      {"text/plain, */*;q=0.1", true},
+		"malformed": {";;;", false},
+	}
+
+	for k, tc := range cases {
+		expect(t, k, prefersText(tc.accept), tc.expected)
+	}
+}
+
+func TestRequestHandlerReport(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	useBackends(t, settings{}, backendURL.Host, "127.0.0.1:1")
+
+	req := httptest.NewRequest("PURGE", "/", nil)
+	req.Header.Set("X-Purge-Regex", ".*")
+	w := httptest.NewRecorder()
+	requestHandler(w, req, loadState())
+	expect(t, "status", w.Code, 207)
+	expect(t, "contenttype", w.Header().Get("Content-Type"), "application/json")
+
+	var report struct {
+		Result   string `json:"result"`
+		Backends []struct {
+			Backend   string  `json:"backend"`
+			Status    int     `json:"status"`
+			LatencyMS float64 `json:"latency_ms"`
+			Error     string  `json:"error"`
+		} `json:"backends"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, "result", report.Result, "partial")
+	expect(t, "backends", len(report.Backends), 2)
+	expect(t, "okbackend", report.Backends[0].Backend, backendURL.Host)
+	expect(t, "okstatus", report.Backends[0].Status, 200)
+	expect(t, "failedbackend", report.Backends[1].Backend, "127.0.0.1:1")
+	expect(t, "failederror", report.Backends[1].Error != "", true)
+
+	req.Header.Set("Accept", "text/plain")
+	w = httptest.NewRecorder()
+	requestHandler(w, req, loadState())
+	expect(t, "textstatus", w.Code, 207)
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	expect(t, "textlines", len(lines), 3)
+	expect(t, "textok", strings.HasPrefix(lines[0], backendURL.Host+" 200 "), true)
+	expect(t, "textfailed", strings.HasPrefix(lines[1], "127.0.0.1:1 - "), true)
+	expect(t, "textsummary", lines[2], "partial: 1 of 2 backends failed")
+}
@@ -0,0 +1,157 @@
+package main
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// retryErrorClasses are the kinds of transport error that can be retried
+var retryErrorClasses = []string{"timeout", "refused", "reset", "other"}
+
+// retryPolicy decides whether and when a failed purge is sent again
+type retryPolicy struct {
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	jitter     bool
+	statuses   []int
+	errors     []string
+}
+
+// delay returns how long to wait before the given retry, starting at 1,
+// doubling from backoff up to maxBackoff. With jitter a random delay up to
+// that is used instead so retries from many requests spread out.
+func (p *retryPolicy) delay(retry int) time.Duration {
+	d := p.backoff
+	for i := 1; i < retry && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	if p.jitter && d > 0 {
+		d = time.Duration(rand.Int63n(int64(d) + 1))
+	}
+	return d
+}
+
+// retryable reports whether a purge that failed with err should be sent
+// again, status is 0 when there was no response
+func (p *retryPolicy) retryable(status int, err error) bool {
+	if err == nil {
+		return false
+	}
+	if status == 0 {
+		class := errorClass(err)
+		for _, c := range p.errors {
+			if c == class {
+				return true
+			}
+		}
+		return false
+	}
+	for _, s := range p.statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// wait sleeps before the given retry, returning false without waiting if
+// ctx would expire first
+func (p *retryPolicy) wait(ctx context.Context, retry int) bool {
+	d := p.delay(retry)
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(d).After(deadline) {
+		return false
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// errorClass sorts a transport error into one of retryErrorClasses
+func errorClass(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "reset"
+	}
+	return "other"
+}
+
+// parseStatusList parses a comma separated list of status codes
+func parseStatusList(value string) ([]int, error) {
+	statuses := []int{}
+	for _, code := range strings.Split(value, ",") {
+		if code = strings.TrimSpace(code); code == "" {
+			continue
+		}
+		status, err := strconv.Atoi(code)
+		if err != nil || status < 100 || status > 599 {
+			return nil, fmt.Errorf("%q is not a status code", code)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// parseErrorClasses parses a comma separated list of retryErrorClasses
+func parseErrorClasses(value string) ([]string, error) {
+	classes := []string{}
+	for _, class := range strings.Split(value, ",") {
+		if class = strings.TrimSpace(class); class == "" {
+			continue
+		}
+		if err := checkErrorClass(class); err != nil {
+			return nil, err
+		}
+		classes = append(classes, class)
+	}
+	return classes, nil
+}
+
+func checkErrorClass(class string) error {
+	for _, c := range retryErrorClasses {
+		if c == class {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown error class %q, expected one of %s", class, strings.Join(retryErrorClasses, ", "))
+}
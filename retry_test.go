@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	p := &retryPolicy{backoff: 100 * time.Millisecond, maxBackoff: time.Second}
+
+	cases := map[string]struct {
+		retry    int
+		expected time.Duration
+	}{
+		"first":  {1, 100 * time.Millisecond},
+		"second": {2, 200 * time.Millisecond},
+		"third":  {3, 400 * time.Millisecond},
+		"capped": {10, time.Second},
+	}
+
+	for k, tc := range cases {
+		expect(t, k, p.delay(tc.retry), tc.expected)
+	}
+
+	p.jitter = true
+	for i := 0; i < 100; i++ {
+		if d := p.delay(3); d < 0 || d > 400*time.Millisecond {
+			t.Fatalf("jitter: Expected a delay up to 400ms - Got %v", d)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	p := &retryPolicy{statuses: []int{503}, errors: []string{"refused", "timeout"}}
+	refused := &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}
+
+	cases := map[string]struct {
+		status   int
+		err      error
+		expected bool
+	}{
+		"success":    {200, nil, false},
+		"status":     {503, errors.New("unexpected status 503"), true},
+		"notstatus":  {405, errors.New("unexpected status 405"), false},
+		"refused":    {0, refused, true},
+		"reset":      {0, &net.OpError{Op: "read", Err: syscall.ECONNRESET}, false},
+		"deadline":   {0, fmt.Errorf("send: %w", context.DeadlineExceeded), true},
+		"bodymatch":  {200, errors.New("response body does not match"), false},
+		"unexpected": {0, errors.New("something else"), false},
+	}
+
+	for k, tc := range cases {
+		expect(t, k, p.retryable(tc.status, tc.err), tc.expected)
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	cases := map[string]struct {
+		err      error
+		expected string
+	}{
+		"refused":  {&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, "refused"},
+		"reset":    {&net.OpError{Op: "read", Err: syscall.ECONNRESET}, "reset"},
+		"eof":      {fmt.Errorf("read: %w", io.EOF), "reset"},
+		"deadline": {context.DeadlineExceeded, "timeout"},
+		"other":    {errors.New("no such host"), "other"},
+	}
+
+	for k, tc := range cases {
+		expect(t, k, errorClass(tc.err), tc.expected)
+	}
+
+	// A real client timeout
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client := &http.Client{Timeout: 10 * time.Millisecond}
+	_, err = client.Get("http://" + listener.Addr().String())
+	expect(t, "clienttimeout", errorClass(err), "timeout")
+}
+
+func TestRetryWait(t *testing.T) {
+	p := &retryPolicy{backoff: time.Second, maxBackoff: time.Second}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	expect(t, "pastdeadline", p.wait(ctx, 1), false)
+	expect(t, "returnedearly", time.Since(start) < 100*time.Millisecond, true)
+
+	p.backoff = time.Millisecond
+	expect(t, "beforedeadline", p.wait(ctx, 1), true)
+}
+
+func TestParseRetryLists(t *testing.T) {
+	statuses, err := parseStatusList("502, 503,504")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, "statuses", len(statuses), 3)
+	expect(t, "status", statuses[1], 503)
+	if _, err := parseStatusList("503,bad"); err == nil {
+		t.Fatal("badstatus: Expected an error")
+	}
+
+	classes, err := parseErrorClasses("timeout,reset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, "classes", len(classes), 2)
+	if _, err := parseErrorClasses("timeout,bogus"); err == nil {
+		t.Fatal("badclass: Expected an error")
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+import (
+	"fmt"
+
+	"github.com/BashtonLtd/varnish-purge-proxy/providers"
+	"gopkg.in/alecthomas/kingpin.v1"
+)
+
+// sourceSeparator separates the commands of several services on the command
+// line, eg. aws Service:varnish + static backends.txt
+const sourceSeparator = "+"
+
+// serviceConfig holds the settings of one discovery service, from either
+// the command line or a --config file
+type serviceConfig struct {
+	Type string `yaml:"type" toml:"type"`
+	Name string `yaml:"name" toml:"name"`
+
+	// AWS and Azure
+	Tags []string `yaml:"tags" toml:"tags"`
+
+	// GCE
+	Credentials string `yaml:"credentials" toml:"credentials"`
+	NamePrefix  string `yaml:"nameprefix" toml:"nameprefix"`
+	Project     string `yaml:"project" toml:"project"`
+	Region      string `yaml:"region" toml:"region"`
+
+	// Azure
+	Subscription  string `yaml:"subscription" toml:"subscription"`
+	ResourceGroup string `yaml:"resourcegroup" toml:"resourcegroup"`
+	ScaleSets     bool   `yaml:"scalesets" toml:"scalesets"`
+
+	// Static
+	File string `yaml:"file" toml:"file"`
+
+	// DNS
+	Record string `yaml:"record" toml:"record"`
+	Server string `yaml:"server" toml:"server"`
+	SRV    bool   `yaml:"srv" toml:"srv"`
+
+	// Kubernetes and Consul
+	Service string `yaml:"service" toml:"service"`
+
+	// Kubernetes
+	Namespace      string `yaml:"namespace" toml:"namespace"`
+	Kubeconfig     string `yaml:"kubeconfig" toml:"kubeconfig"`
+	PortName       string `yaml:"portname" toml:"portname"`
+	EndpointSlices bool   `yaml:"endpointslices" toml:"endpointslices"`
+	Watch          bool   `yaml:"watch" toml:"watch"`
+
+	// Consul
+	Address    string `yaml:"address" toml:"address"`
+	Token      string `yaml:"token" toml:"token"`
+	Tag        string `yaml:"tag" toml:"tag"`
+	Datacenter string `yaml:"datacenter" toml:"datacenter"`
+}
+
+// serviceCommands holds the commands and args used to select a service
+type serviceCommands struct {
+	// AWS service args
+	awsService *kingpin.CmdClause
+	tags       *[]string
+
+	// GCE service args
+	gceService  *kingpin.CmdClause
+	credentials *string
+	nameprefix  *string
+	project     *string
+	region      *string
+
+	// Azure service args
+	azureService       *kingpin.CmdClause
+	azureTags          *[]string
+	azureSubscription  *string
+	azureResourceGroup *string
+	azureScaleSets     *bool
+
+	// Static service args
+	staticService *kingpin.CmdClause
+	staticFile    *string
+
+	// DNS service args
+	dnsService *kingpin.CmdClause
+	dnsName    *string
+	dnsServer  *string
+	dnsSRV     *bool
+
+	// Kubernetes service args
+	k8sService        *kingpin.CmdClause
+	k8sServiceName    *string
+	k8sNamespace      *string
+	k8sKubeconfig     *string
+	k8sPortName       *string
+	k8sEndpointSlices *bool
+	k8sWatch          *bool
+
+	// Consul service args
+	consulService    *kingpin.CmdClause
+	consulName       *string
+	consulAddress    *string
+	consulToken      *string
+	consulTag        *string
+	consulDatacenter *string
+}
+
+// registerServiceCommands adds a command for each service to app
+func registerServiceCommands(app *kingpin.Application) *serviceCommands {
+	c := &serviceCommands{}
+
+	c.awsService = app.Command("aws", "Use AWS service.")
+	c.tags = c.awsService.Arg("tag", "Key:value pair of tags to match EC2 instances.").Required().Strings()
+
+	c.gceService = app.Command("gce", "Use GCE service.")
+	c.credentials = c.gceService.Flag("credentials", "Path to service account JSON credentials").Required().String()
+	c.nameprefix = c.gceService.Flag("nameprefix", "Instance name prefix, eg. varnish").Default("varnish").String()
+	c.project = c.gceService.Flag("project", "Google project to discover varnish servers").Required().String()
+	c.region = c.gceService.Flag("region", "Google region to discover varnish servers").Required().String()
+
+	c.azureService = app.Command("azure", "Use Azure service.")
+	c.azureTags = c.azureService.Arg("tag", "Key:value pair of tags to match VMs or scale sets.").Strings()
+	c.azureSubscription = c.azureService.Flag("subscription", "Azure subscription ID, defaults to AZURE_SUBSCRIPTION_ID.").String()
+	c.azureResourceGroup = c.azureService.Flag("resourcegroup", "Resource group to discover varnish servers").Required().String()
+	c.azureScaleSets = c.azureService.Flag("scalesets", "Discover VM scale set instances instead of VMs.").Bool()
+
+	c.staticService = app.Command("static", "Use a static list of backends read from a file.")
+	c.staticFile = c.staticService.Arg("file", "Path to a YAML, JSON or plain text file listing backends as host[:port].").Required().String()
+
+	c.dnsService = app.Command("dns", "Use DNS A/AAAA or SRV records.")
+	c.dnsName = c.dnsService.Arg("name", "DNS name resolving to the varnish servers.").Required().String()
+	c.dnsServer = c.dnsService.Flag("server", "DNS server to query as host[:port], defaults to the system resolver.").String()
+	c.dnsSRV = c.dnsService.Flag("srv", "Look up SRV records and use the port from each record instead of --destport.").Bool()
+
+	c.k8sService = app.Command("k8s", "Use Kubernetes service endpoints.")
+	c.k8sServiceName = c.k8sService.Arg("service", "Name of the Kubernetes service in front of the varnish pods.").Required().String()
+	c.k8sNamespace = c.k8sService.Flag("namespace", "Namespace of the service, defaults to the current namespace.").String()
+	c.k8sKubeconfig = c.k8sService.Flag("kubeconfig", "Path to a kubeconfig file, defaults to in-cluster service account credentials.").String()
+	c.k8sPortName = c.k8sService.Flag("portname", "Name of the endpoint port to target instead of --destport.").String()
+	c.k8sEndpointSlices = c.k8sService.Flag("endpointslices", "Use EndpointSlices instead of Endpoints.").Bool()
+	c.k8sWatch = c.k8sService.Flag("watch", "Watch the endpoints for changes instead of polling.").Bool()
+
+	c.consulService = app.Command("consul", "Use Consul service catalog.")
+	c.consulName = c.consulService.Arg("service", "Name of the Consul service to discover varnish servers.").Required().String()
+	c.consulAddress = c.consulService.Flag("address", "Consul HTTP address, defaults to CONSUL_HTTP_ADDR or 127.0.0.1:8500.").String()
+	c.consulToken = c.consulService.Flag("token", "Consul ACL token, defaults to CONSUL_HTTP_TOKEN.").String()
+	c.consulTag = c.consulService.Flag("tag", "Only use instances with this tag.").String()
+	c.consulDatacenter = c.consulService.Flag("datacenter", "Consul datacenter to query, defaults to the agent's datacenter.").String()
+
+	return c
+}
+
+// config returns the settings of the parsed command
+func (c *serviceCommands) config(command string) serviceConfig {
+	switch command {
+	case c.awsService.FullCommand():
+		return serviceConfig{
+			Type: "aws",
+			Tags: *c.tags,
+		}
+	case c.gceService.FullCommand():
+		return serviceConfig{
+			Type:        "gce",
+			Credentials: *c.credentials,
+			NamePrefix:  *c.nameprefix,
+			Project:     *c.project,
+			Region:      *c.region,
+		}
+	case c.azureService.FullCommand():
+		return serviceConfig{
+			Type:          "azure",
+			Tags:          *c.azureTags,
+			Subscription:  *c.azureSubscription,
+			ResourceGroup: *c.azureResourceGroup,
+			ScaleSets:     *c.azureScaleSets,
+		}
+	case c.staticService.FullCommand():
+		return serviceConfig{
+			Type: "static",
+			File: *c.staticFile,
+		}
+	case c.dnsService.FullCommand():
+		return serviceConfig{
+			Type:   "dns",
+			Record: *c.dnsName,
+			Server: *c.dnsServer,
+			SRV:    *c.dnsSRV,
+		}
+	case c.k8sService.FullCommand():
+		return serviceConfig{
+			Type:           "k8s",
+			Service:        *c.k8sServiceName,
+			Namespace:      *c.k8sNamespace,
+			Kubeconfig:     *c.k8sKubeconfig,
+			PortName:       *c.k8sPortName,
+			EndpointSlices: *c.k8sEndpointSlices,
+			Watch:          *c.k8sWatch,
+		}
+	case c.consulService.FullCommand():
+		return serviceConfig{
+			Type:       "consul",
+			Service:    *c.consulName,
+			Address:    *c.consulAddress,
+			Token:      *c.consulToken,
+			Tag:        *c.consulTag,
+			Datacenter: *c.consulDatacenter,
+		}
+	}
+	return serviceConfig{Type: command}
+}
+
+// splitSourceArgs splits command line args into the args of each service
+func splitSourceArgs(args []string) [][]string {
+	sources := [][]string{{}}
+	for _, arg := range args {
+		if arg == sourceSeparator {
+			sources = append(sources, []string{})
+			continue
+		}
+		sources[len(sources)-1] = append(sources[len(sources)-1], arg)
+	}
+	return sources
+}
+
+// nameSources gives each config a unique name, defaulting to its type
+func nameSources(configs []serviceConfig) {
+	used := map[string]int{}
+	for i := range configs {
+		if configs[i].Name == "" {
+			configs[i].Name = configs[i].Type
+		}
+		used[configs[i].Name]++
+		if n := used[configs[i].Name]; n > 1 {
+			configs[i].Name = fmt.Sprintf("%s-%d", configs[i].Name, n)
+		}
+	}
+}
+
+// newService returns an authenticated service for config
+func newService(config serviceConfig, debug bool) (providers.Service, error) {
+	var service providers.Service
+	var description string
+
+	switch config.Type {
+	case "aws":
+		description = "AWS"
+		service = &providers.AWSProvider{
+			Tags:  config.Tags,
+			Debug: debug,
+		}
+	case "gce":
+		description = "GCE"
+		service = &providers.GCEProvider{
+			Credentials: config.Credentials,
+			Debug:       debug,
+			NamePrefix:  config.NamePrefix,
+			Project:     config.Project,
+			Region:      config.Region,
+		}
+	case "azure":
+		description = "Azure"
+		service = &providers.AzureProvider{
+			SubscriptionID: config.Subscription,
+			ResourceGroup:  config.ResourceGroup,
+			Tags:           config.Tags,
+			ScaleSets:      config.ScaleSets,
+			Debug:          debug,
+		}
+	case "static":
+		description = "Static"
+		service = &providers.StaticProvider{
+			File:  config.File,
+			Debug: debug,
+		}
+	case "dns":
+		description = "DNS"
+		service = &providers.DNSProvider{
+			Name:   config.Record,
+			Server: config.Server,
+			SRV:    config.SRV,
+			Debug:  debug,
+		}
+	case "k8s":
+		description = "Kubernetes"
+		service = &providers.KubernetesProvider{
+			Kubeconfig:     config.Kubeconfig,
+			Namespace:      config.Namespace,
+			ServiceName:    config.Service,
+			PortName:       config.PortName,
+			EndpointSlices: config.EndpointSlices,
+			Watch:          config.Watch,
+			Debug:          debug,
+		}
+	case "consul":
+		description = "Consul"
+		service = &providers.ConsulProvider{
+			Address:    config.Address,
+			Token:      config.Token,
+			Service:    config.Service,
+			Tag:        config.Tag,
+			Datacenter: config.Datacenter,
+			Debug:      debug,
+		}
+	default:
+		return nil, fmt.Errorf("unknown service type %q", config.Type)
+	}
+
+	if err := service.Auth(); err != nil {
+		return nil, fmt.Errorf("failed to authenticate %s service %s: %v", description, config.Name, err)
+	}
+	return service, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/alecthomas/kingpin.v1"
+)
+
+func TestSplitSourceArgs(t *testing.T) {
+	cases := map[string]struct {
+		args     []string
+		expected [][]string
+	}{
+		"single": {[]string{"--port=8001", "aws", "Service:varnish"}, [][]string{{"--port=8001", "aws", "Service:varnish"}}},
+		"multi":  {[]string{"aws", "Service:varnish", "+", "static", "backends.txt"}, [][]string{{"aws", "Service:varnish"}, {"static", "backends.txt"}}},
+		"empty":  {[]string{}, [][]string{{}}},
+	}
+
+	for k, tc := range cases {
+		if sources := splitSourceArgs(tc.args); !reflect.DeepEqual(sources, tc.expected) {
+			t.Fatalf("%s: Expected %v - Got %v", k, tc.expected, sources)
+		}
+	}
+}
+
+func TestNameSources(t *testing.T) {
+	configs := []serviceConfig{{Type: "aws"}, {Type: "static"}, {Type: "aws"}, {Type: "dns", Name: "internal"}}
+	nameSources(configs)
+	expect(t, "first", configs[0].Name, "aws")
+	expect(t, "second", configs[1].Name, "static")
+	expect(t, "duplicate", configs[2].Name, "aws-2")
+	expect(t, "named", configs[3].Name, "internal")
+}
+
+func TestServiceCommands(t *testing.T) {
+	app := kingpin.New("test", "")
+	commands := registerServiceCommands(app)
+	command, err := app.Parse([]string{"dns", "--srv", "_http._tcp.varnish.internal"})
+	expect(t, "parse", err, nil)
+
+	config := commands.config(command)
+	expect(t, "type", config.Type, "dns")
+	expect(t, "record", config.Record, "_http._tcp.varnish.internal")
+	expect(t, "srv", config.SRV, true)
+}
@@ -0,0 +1,95 @@
+package main
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxCheckedBody is how much of a varnish response is read to match against
+// the success body
+const maxCheckedBody = 64 * 1024
+
+// successCriteria decides whether a varnish server accepted a purge
+type successCriteria struct {
+	// statuses lists the accepted status codes by method, methods not
+	// listed accept any 2xx status
+	statuses map[string][]int
+	// body must match the response body when set
+	body *regexp.Regexp
+}
+
+// newSuccessCriteria returns the criteria for accepted statuses and a body
+// regular expression, which may be empty
+func newSuccessCriteria(statuses map[string][]int, body string) (*successCriteria, error) {
+	c := &successCriteria{statuses: map[string][]int{}}
+	for method, codes := range statuses {
+		c.statuses[strings.ToUpper(method)] = codes
+	}
+	if body != "" {
+		re, err := regexp.Compile(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid success body %q: %v", body, err)
+		}
+		c.body = re
+	}
+	return c, nil
+}
+
+// check returns an error describing why a response is not a success
+func (c *successCriteria) check(method string, status int, body []byte) error {
+	codes, ok := c.statuses[method]
+	accepted := !ok && status >= 200 && status < 300
+	for _, code := range codes {
+		if code == status {
+			accepted = true
+		}
+	}
+	if !accepted {
+		return fmt.Errorf("unexpected status %d", status)
+	}
+	if c.body != nil && !c.body.Match(body) {
+		return fmt.Errorf("response body does not match %q", c.body)
+	}
+	return nil
+}
+
+// parseAcceptStatus parses values of the form METHOD=code[,code...]
+func parseAcceptStatus(values []string) (map[string][]int, error) {
+	statuses := map[string][]int{}
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid accepted status %q, expected METHOD=code[,code...]", value)
+		}
+		method := strings.ToUpper(parts[0])
+		for _, code := range strings.Split(parts[1], ",") {
+			status, err := strconv.Atoi(strings.TrimSpace(code))
+			if err != nil || status < 100 || status > 599 {
+				return nil, fmt.Errorf("invalid accepted status %q, %q is not a status code", value, code)
+			}
+			statuses[method] = append(statuses[method], status)
+		}
+	}
+	return statuses, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSuccessCriteria(t *testing.T) {
+	statuses := map[string][]int{"purge": {200, 204}, "BAN": {200}}
+
+	cases := map[string]struct {
+		body     string
+		method   string
+		status   int
+		response string
+		expected string
+	}{
+		"purgeok":      {"", "PURGE", 204, "", ""},
+		"purgerefused": {"", "PURGE", 201, "", "unexpected status 201"},
+		"banok":        {"", "BAN", 200, "", ""},
+		"other2xx":     {"", "GET", 202, "", ""},
+		"other405":     {"", "GET", 405, "", "unexpected status 405"},
+		"bodyok":       {"^Purged", "PURGE", 200, "Purged 3 objects", ""},
+		"bodymismatch": {"^Purged", "PURGE", 200, "<html>Error</html>", `response body does not match "^Purged"`},
+	}
+
+	for k, tc := range cases {
+		c, err := newSuccessCriteria(statuses, tc.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.check(tc.method, tc.status, []byte(tc.response))
+		if tc.expected == "" {
+			expect(t, k, err, nil)
+		} else if err == nil || err.Error() != tc.expected {
+			t.Fatalf("%s: Expected error %q - Got %v", k, tc.expected, err)
+		}
+	}
+
+	if _, err := newSuccessCriteria(nil, "("); err == nil {
+		t.Fatal("invalidbody: Expected an error")
+	}
+}
+
+func TestParseAcceptStatus(t *testing.T) {
+	statuses, err := parseAcceptStatus([]string{"purge=200,204", "BAN=200"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, "purge", len(statuses["PURGE"]), 2)
+	expect(t, "purge204", statuses["PURGE"][1], 204)
+	expect(t, "ban", statuses["BAN"][0], 200)
+
+	cases := map[string]string{
+		"noequals": "PURGE",
+		"nomethod": "=200",
+		"notcode":  "PURGE=ok",
+		"range":    "PURGE=42",
+	}
+	for k, value := range cases {
+		if _, err := parseAcceptStatus([]string{value}); err == nil || !strings.Contains(err.Error(), "invalid accepted status") {
+			t.Fatalf("%s: Expected an invalid accepted status error - Got %v", k, err)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+/*
+ * varnish-purge-proxy
+ * (C) Copyright Bashton Ltd, 2014
+ *
+ * varnish-purge-proxy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * varnish-purge-proxy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with varnish-purge-proxy.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Headers the xkey vmod purges and soft purges are read from by our VCL
+const (
+	xkeyPurgeHeader     = "Xkey-Purge"
+	xkeySoftPurgeHeader = "Xkey-Softpurge"
+)
+
+// softPurgeHeader asks for the tags in a request to be soft purged
+const softPurgeHeader = "X-Purge-Soft"
+
+// tagHeaders are the request headers cache tags are accepted from
+var tagHeaders = []string{"Xkey", "Surrogate-Key", xkeyPurgeHeader, xkeySoftPurgeHeader}
+
+// tagPurge is a purge of every object tagged with one of its keys
+type tagPurge struct {
+	Keys []string `json:"keys"`
+	// Soft marks objects as expired instead of removing them, so they can
+	// still be served while stale or in grace
+	Soft bool `json:"soft"`
+}
+
+// hasTagHeaders reports whether r carries cache tags in its headers
+func hasTagHeaders(r *http.Request) bool {
+	for _, name := range tagHeaders {
+		if _, ok := r.Header[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTagPurge reads cache tags from the headers of r and a JSON body,
+// either {"keys": [...], "soft": true} or a list of keys
+func parseTagPurge(r *http.Request, body []byte) (tagPurge, error) {
+	p := tagPurge{}
+	for _, name := range tagHeaders {
+		for _, value := range r.Header[name] {
+			p.Keys = append(p.Keys, splitTags(value)...)
+		}
+	}
+	if _, ok := r.Header[xkeySoftPurgeHeader]; ok {
+		p.Soft = true
+	}
+	if soft := r.Header.Get(softPurgeHeader); soft != "" {
+		s, err := strconv.ParseBool(soft)
+		if err != nil {
+			return p, fmt.Errorf("invalid %s header %q", softPurgeHeader, soft)
+		}
+		p.Soft = p.Soft || s
+	}
+
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 {
+		decoded := tagPurge{}
+		var err error
+		if body[0] == '[' {
+			err = json.Unmarshal(body, &decoded.Keys)
+		} else {
+			decoder := json.NewDecoder(bytes.NewReader(body))
+			decoder.DisallowUnknownFields()
+			err = decoder.Decode(&decoded)
+		}
+		if err != nil {
+			return p, fmt.Errorf("invalid cache tags: %v", err)
+		}
+		p.Keys = append(p.Keys, decoded.Keys...)
+		p.Soft = p.Soft || decoded.Soft
+	}
+
+	return p, p.validate()
+}
+
+// splitTags splits a header value into keys, separated by spaces or commas
+// as in the xkey and Surrogate-Key headers
+func splitTags(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ' ' || r == ',' || r == '\t'
+	})
+}
+
+// validate checks that there is at least one key and that each can be sent
+// in a header, removing duplicates
+func (p *tagPurge) validate() error {
+	if len(p.Keys) == 0 {
+		return fmt.Errorf("purge needs an X-Purge-Regex header or cache tags")
+	}
+	seen := map[string]bool{}
+	keys := []string{}
+	for _, key := range p.Keys {
+		if key == "" || strings.ContainsAny(key, " ,") {
+			return fmt.Errorf("invalid cache tag %q", key)
+		}
+		if err := checkBanValue("cache tag", key); err != nil {
+			return err
+		}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	p.Keys = keys
+	return nil
+}
+
+// header returns the header the xkey vmod reads the purge from
+func (p tagPurge) header() string {
+	if p.Soft {
+		return xkeySoftPurgeHeader
+	}
+	return xkeyPurgeHeader
+}
+
+// prepareTagPurge checks a PURGE request without X-Purge-Regex, replacing
+// its cache tags with the header the xkey vmod purges by
+func prepareTagPurge(r *http.Request, body []byte) error {
+	p, err := parseTagPurge(r, body)
+	if err != nil {
+		return err
+	}
+	r.Header = r.Header.Clone()
+	for _, name := range append(tagHeaders, softPurgeHeader, "Content-Type", "Content-Length") {
+		r.Header.Del(name)
+	}
+	r.Header.Set(p.header(), strings.Join(p.Keys, " "))
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseTagPurge(t *testing.T) {
+	cases := map[string]struct {
+		headers map[string]string
+		body    string
+		keys    string
+		soft    bool
+		err     bool
+	}{
+		"xkey":          {map[string]string{"Xkey": "product-1 category-2"}, "", "product-1 category-2", false, false},
+		"surrogate":     {map[string]string{"Surrogate-Key": "a, b,a"}, "", "a b", false, false},
+		"softheader":    {map[string]string{"Xkey-Softpurge": "a"}, "", "a", true, false},
+		"softflag":      {map[string]string{"Xkey": "a", "X-Purge-Soft": "true"}, "", "a", true, false},
+		"badsoftflag":   {map[string]string{"Xkey": "a", "X-Purge-Soft": "maybe"}, "", "", false, true},
+		"jsonobject":    {nil, `{"keys": ["a", "b"], "soft": true}`, "a b", true, false},
+		"jsonlist":      {nil, `["a", "b"]`, "a b", false, false},
+		"combined":      {map[string]string{"Xkey": "a"}, `["b"]`, "a b", false, false},
+		"unknownfield":  {nil, `{"tags": ["a"]}`, "", false, true},
+		"notjson":       {nil, "a b", "", false, true},
+		"emptykey":      {nil, `[""]`, "", false, true},
+		"spacedkey":     {nil, `["a b"]`, "", false, true},
+		"quotedkey":     {nil, `["a\""]`, "", false, true},
+		"none":          {nil, "", "", false, true},
+		"emptyjsonlist": {nil, "[]", "", false, true},
+	}
+
+	for k, tc := range cases {
+		r := httptest.NewRequest("PURGE", "/", nil)
+		for name, value := range tc.headers {
+			r.Header.Set(name, value)
+		}
+		p, err := parseTagPurge(r, []byte(tc.body))
+		expect(t, k, err != nil, tc.err)
+		if tc.err {
+			continue
+		}
+		expect(t, k, strings.Join(p.Keys, " "), tc.keys)
+		expect(t, k, p.Soft, tc.soft)
+	}
+}
+
+func TestTagPurgeRequest(t *testing.T) {
+	received := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	useBackends(t, settings{}, backendURL.Host)
+	handler := newServer(loadState().settings).Handler
+
+	cases := map[string]struct {
+		headers map[string]string
+		body    string
+		status  int
+		purge   string
+		soft    string
+	}{
+		"xkey":       {map[string]string{"Xkey": "product-1"}, "", 200, "product-1", ""},
+		"surrogate":  {map[string]string{"Surrogate-Key": "a b"}, "", 200, "a b", ""},
+		"json":       {map[string]string{"Content-Type": "application/json"}, `{"keys": ["a"], "soft": true}`, 200, "", "a"},
+		"regex":      {map[string]string{"X-Purge-Regex": ".*"}, "", 200, "", ""},
+		"regextags":  {map[string]string{"X-Purge-Regex": ".*", "Xkey": "a"}, "", 400, "", ""},
+		"nothing":    {nil, "", 400, "", ""},
+		"invalidkey": {map[string]string{"Xkey": `"a"`}, "", 400, "", ""},
+	}
+
+	for k, tc := range cases {
+		req := httptest.NewRequest("PURGE", "/", strings.NewReader(tc.body))
+		for name, value := range tc.headers {
+			req.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		expect(t, k, w.Code, tc.status)
+		if tc.status != 200 {
+			continue
+		}
+		header := <-received
+		expect(t, k, header.Get(xkeyPurgeHeader), tc.purge)
+		expect(t, k, header.Get(xkeySoftPurgeHeader), tc.soft)
+		expect(t, k, header.Get("Xkey"), "")
+		expect(t, k, header.Get("Surrogate-Key"), "")
+	}
+}
@@ -19,15 +19,23 @@ package main
  *
  */
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"log/syslog"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/BashtonLtd/varnish-purge-proxy/providers"
@@ -36,154 +44,380 @@ import (
 
 var (
 	// Global application args
-	app      = kingpin.New("varnish-purge-proxy", "Proxy purge requests to multiple varnish servers.")
-	cache    = app.Flag("cache", "Time in seconds to cache instance IP lookup.").Default("60").Int()
-	debug    = app.Flag("debug", "Log additional debug messages.").Bool()
-	destport = app.Flag("destport", "The destination port of the varnish server to target.").Default("80").Int()
-	listen   = app.Flag("listen", "Host address to listen on, defaults to 127.0.0.1").Default("127.0.0.1").String()
-	port     = app.Flag("port", "Port to listen on.").Default("8000").Int()
-
-	// AWS service args
-	awsService = app.Command("aws", "Use AWS service.")
-	tags       = awsService.Arg("tag", "Key:value pair of tags to match EC2 instances.").Required().Strings()
-
-	// GCE service args
-	gceService  = app.Command("gce", "Use GCE service.")
-	credentials = gceService.Flag("credentials", "Path to service account JSON credentials").Required().String()
-	nameprefix  = gceService.Flag("nameprefix", "Instance name prefix, eg. varnish").Default("varnish").String()
-	project     = gceService.Flag("project", "Google project to discover varnish servers").Required().String()
-	region      = gceService.Flag("region", "Google region to discover varnish servers").Required().String()
+	app             = kingpin.New("varnish-purge-proxy", "Proxy purge requests to multiple varnish servers.")
+	cache           = app.Flag("cache", "Time in seconds to cache instance IP lookup.").Default("60").Int()
+	configFile      = app.Flag("config", "Path to a YAML or TOML configuration file, flags override its settings.").String()
+	debug           = app.Flag("debug", "Log additional debug messages.").Bool()
+	destport        = app.Flag("destport", "The destination port of the varnish server to target.").Default("80").Int()
+	listen          = app.Flag("listen", "Host address to listen on, defaults to 127.0.0.1").Default("127.0.0.1").String()
+	port            = app.Flag("port", "Port to listen on.").Default("8000").Int()
+	timeout         = app.Flag("timeout", "Timeout for requests to each varnish server.").Default("5s").Duration()
+	readTimeout     = app.Flag("read-timeout", "Timeout for reading purge requests.").Default("10s").Duration()
+	writeTimeout    = app.Flag("write-timeout", "Timeout for writing purge responses.").Default("10s").Duration()
+	partialStatus   = app.Flag("partial-status", "Status code to respond with when some varnish servers fail.").Default("207").Int()
+	failureStatus   = app.Flag("failure-status", "Status code to respond with when every varnish server fails.").Default("500").Int()
+	acceptStatus    = app.Flag("accept-status", "Status codes counted as success for a method, eg. PURGE=200,204, defaults to any 2xx. Can be repeated.").Strings()
+	purgeTimeout    = app.Flag("purge-timeout", "Time limit for sending a purge to every varnish server, including retries.").Default("8s").Duration()
+	coalesceWindow  = app.Flag("coalesce-window", "Time within which identical purges are merged into one, 0 to disable.").Default("0s").Duration()
+	retries         = app.Flag("retries", "Maximum attempts at sending a purge to each varnish server.").Default("3").Int()
+	retryBackoff    = app.Flag("retry-backoff", "Delay before the first retry, doubled for each further retry.").Default("100ms").Duration()
+	retryMaxBackoff = app.Flag("retry-max-backoff", "Maximum delay between retries.").Default("2s").Duration()
+	retryJitter     = app.Flag("retry-jitter", "Randomise the delay between retries.").Default("true").Bool()
+	retryStatus     = app.Flag("retry-status", "Comma separated status codes to retry.").Default("502,503,504").String()
+	retryError      = app.Flag("retry-error", "Comma separated errors to retry: timeout, refused, reset or other.").Default("timeout,refused,reset").String()
+	successBody     = app.Flag("success-body", "Regular expression varnish responses must match to count as success.").String()
+	queueDir        = app.Flag("queue-dir", "Directory to keep a queue of purges in, purges are then accepted straight away and delivered in the background.").String()
+	queueWorkers    = app.Flag("queue-workers", "Number of queued purges to deliver at once.").Default("4").Int()
+	queueRetain     = app.Flag("queue-retain", "Number of finished queued purges to keep the status of.").Default("1000").Int()
+	queueAttempts   = app.Flag("queue-attempts", "Maximum times a queued purge is delivered to the varnish servers it has not reached yet.").Default("10").Int()
+	queueBackoff    = app.Flag("queue-backoff", "Delay before a queued purge is delivered again, doubled for each further delivery.").Default("5s").Duration()
+	queueMaxBackoff = app.Flag("queue-max-backoff", "Maximum delay between deliveries of a queued purge.").Default("5m").Duration()
+	queueMaxAge     = app.Flag("queue-max-age", "Time after which a queued purge is no longer delivered again, 0 to disable.").Default("1h").Duration()
+	readyMaxAge     = app.Flag("ready-max-age", "Report not ready in /readyz when backends were last found longer ago than this, 0 to disable.").Default("5m").Duration()
+	shutdownTimeout = app.Flag("shutdown-timeout", "Maximum time to wait for purges in progress when stopping.").Default("10s").Duration()
+	transport       = app.Flag("transport", "How purges reach varnish: http to forward them, or cli to add bans over the varnish management port.").Default("http").Enum("http", "cli")
+	cliPort         = app.Flag("cli-port", "The varnish management port to ban through with --transport=cli.").Default("6082").Int()
+	cliSecret       = app.Flag("cli-secret", "Path to the varnish secret file used to authenticate to the management port.").String()
+	authTokens      = app.Flag("auth-tokens", "Path to a file of \"name token\" lines, purges must then carry one of the bearer tokens or be signed.").String()
+	authKeys        = app.Flag("auth-hmac-keys", "Path to a file of \"name key\" lines, purges must then be signed with one of the keys or carry a token.").String()
+	authMaxSkew     = app.Flag("auth-max-skew", "Maximum age of the timestamp of a signed purge.").Default("5m").Duration()
+
+	// Use the services from the config file when no command is given
+	configService = app.Command("run", "Use the services listed in the --config file.").Default()
+
+	// Service commands, several can be given separated by +
+	commands = registerServiceCommands(app)
 
 	// Application variables
-	resetAfter      time.Time
-	service         providers.Service
-	taggedInstances = []string{}
+	purgeJobs *purgeQueue
 )
 
+// maxPurgeBody is the longest body accepted with a purge, which only ever
+// carries ban criteria or cache tags
+const maxPurgeBody = 64 * 1024
+
 func main() {
 	kingpin.Version("3.0.1")
 
 	// Log to syslog
 	sl, err := syslog.New(syslog.LOG_NOTICE|syslog.LOG_LOCAL0, "[varnish-purge-proxy]")
-	defer sl.Close()
 	if err != nil {
 		log.Println("Error writing to syslog")
 	} else {
+		defer sl.Close()
 		log.SetFlags(0)
 		log.SetOutput(sl)
 	}
 
-	switch kingpin.MustParse(app.Parse(os.Args[1:])) {
-	// Register user
-	case awsService.FullCommand():
-		service = &providers.AWSProvider{
-			Tags:  *tags,
-			Debug: *debug,
-		}
-		err := service.Auth()
-		if err != nil {
-			log.Fatalln("Failed to Authenticate AWS Service:", err)
-		}
-	case gceService.FullCommand():
-		service = &providers.GCEProvider{
-			Credentials: *credentials,
-			Debug:       *debug,
-			NamePrefix:  *nameprefix,
-			Project:     *project,
-			Region:      *region,
-		}
-		err := service.Auth()
+	sourceArgs := splitSourceArgs(os.Args[1:])
+	command := kingpin.MustParse(app.Parse(sourceArgs[0]))
+	configs := []serviceConfig{}
+	if command != configService.FullCommand() {
+		configs = append(configs, commands.config(command))
+	}
+	for _, args := range sourceArgs[1:] {
+		// Each further service is parsed on its own so its args can't
+		// clash with those of the first, global flags must come first
+		sourceApp := kingpin.New(app.Name, app.Help)
+		sourceCommands := registerServiceCommands(sourceApp)
+		configs = append(configs, sourceCommands.config(kingpin.MustParse(sourceApp.Parse(args))))
+	}
+
+	base, err := flagSettings()
+	if err != nil {
+		app.Fatalf("%v", err)
+	}
+	rl := &reloader{
+		base:     base,
+		explicit: explicitFlags(app, sourceArgs[0]),
+		services: configs,
+	}
+	state, err := rl.load()
+	if err != nil {
+		log.Println(err)
+		app.Fatalf("%v", err)
+	}
+	*debug = state.settings.debug
+	currentState.Store(state)
+
+	// Find backends before serving, then keep them up to date in the
+	// background
+	registry.refresh(state)
+	registry.watch(state)
+	go registry.refreshLoop(nil)
+
+	if state.settings.queueDir != "" {
+		purgeJobs, err = openQueue(state.settings.queueDir, state.settings.queueRetain)
 		if err != nil {
-			log.Fatalln("Failed to Authenticate GCE Service:", err)
+			log.Println(err)
+			app.Fatalf("unable to open purge queue: %v", err)
 		}
+		purgeJobs.start(state.settings.queueWorkers, func(job *purgeJob) {
+			deliverJob(purgeJobs, job)
+		})
 	}
 
-	go serveHTTP(*port, *listen, service)
+	server := newServer(state.settings)
+	go serveHTTP(server)
 
-	select {}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			rl.reload()
+			continue
+		}
+		log.Printf("Received %v, shutting down\n", sig)
+		shutdown(server, loadState())
+		return
+	}
 }
 
-func serveHTTP(port int, host string, service providers.Service) {
-	timeout := time.Duration(5 * time.Second)
-	client := http.Client{
-		Timeout: timeout,
+// newServer returns a server for purge and status requests
+func newServer(settings settings) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		statusHandler(w, r, loadState())
+	})
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/healthz", healthHandler)
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		readyHandler(w, r, loadState())
+	})
+	mux.HandleFunc("/purges", func(w http.ResponseWriter, r *http.Request) {
+		purgesHandler(w, r, loadState())
+	})
+	mux.HandleFunc("/purges/", func(w http.ResponseWriter, r *http.Request) {
+		purgeHandler(w, r, loadState())
+	})
+	purge := func(w http.ResponseWriter, r *http.Request) {
+		state := loadState()
+		state.requests.RLock()
+		defer state.requests.RUnlock()
+		requestHandler(w, r, state)
 	}
+	mux.HandleFunc("/purge/bulk", func(w http.ResponseWriter, r *http.Request) {
+		state := loadState()
+		state.requests.RLock()
+		defer state.requests.RUnlock()
+		bulkHandler(w, r, state)
+	})
+	mux.HandleFunc("/", purge)
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		requestHandler(w, r, &client, service)
+	// Purges and bans go straight to requestHandler so that any path can be
+	// purged, including those of the endpoints above
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PURGE" || r.Method == "BAN" {
+			purge(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
 	})
 
-	addr := fmt.Sprintf("%v:%d", host, port)
-	server := &http.Server{
-		Addr:           addr,
-		Handler:        mux,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
+	return &http.Server{
+		Addr:           fmt.Sprintf("%v:%d", settings.listen, settings.port),
+		Handler:        handler,
+		ReadTimeout:    settings.readTimeout,
+		WriteTimeout:   settings.writeTimeout,
 		MaxHeaderBytes: 1 << 20,
 	}
+}
 
-	log.Println("Listening for requests at", addr)
+func serveHTTP(server *http.Server) {
+	log.Println("Listening for requests at", server.Addr)
 	err := server.ListenAndServe()
-	log.Println(err.Error())
+	if err != http.ErrServerClosed {
+		log.Println(err.Error())
+	}
+}
+
+// shutdown stops accepting requests and waits, up to the shutdown timeout,
+// for purges in progress to reach every backend before stopping the service
+func shutdown(server *http.Server, state *proxyState) {
+	ctx, cancel := context.WithTimeout(context.Background(), state.settings.shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Gave up waiting for purges in progress after %v: %v\n", state.settings.shutdownTimeout, err)
+	} else {
+		log.Println("All purges finished")
+	}
+	// Queued purges not yet delivered are picked up again on restart
+	if purgeJobs != nil {
+		if err := purgeJobs.close(ctx); err != nil {
+			log.Printf("Gave up waiting for queued purges in progress: %v\n", err)
+		}
+	}
+	if stopper, ok := state.service.(providers.Stopper); ok {
+		stopper.Stop()
+	}
 }
 
-func requestHandler(w http.ResponseWriter, r *http.Request, client *http.Client, service providers.Service) {
-	// check that request is PURGE and has X-Purge-Regex header set
-	if _, exists := r.Header["X-Purge-Regex"]; !exists || r.Method != "PURGE" {
+func requestHandler(w http.ResponseWriter, r *http.Request, state *proxyState) {
+	// check that request is a PURGE or BAN
+	if r.Method != "PURGE" && r.Method != "BAN" {
 		if *debug {
 			log.Printf("Error invalid request: %s, %s\n", r.Header, r.Method)
 		}
+		// Other methods share a label, so clients can't add series at will
+		purgesReceived.inc("other", "invalid")
 		http.Error(w, http.StatusText(400), 400)
 		return
 	}
 
-	privateIPs := taggedInstances
-	// Check instance cache
-	if time.Now().After(resetAfter) {
-		privateIPs = service.GetPrivateIPs()
-		resetAfter = time.Now().Add(time.Duration(*cache*1000) * time.Millisecond)
-		taggedInstances = privateIPs
+	// Read the body once so it can be sent to each server, and again on retry
+	body, ok := readBody(w, r, maxPurgeBody)
+	if !ok {
+		return
 	}
 
-	log.Printf("Sending PURGE to: %+v", privateIPs)
+	if !checkAuth(w, r, body, state) {
+		return
+	}
+
+	// Purges either carry an X-Purge-Regex header for the VCL, or are bans
+	// and tag purges translated into the headers the VCL reads
+	_, hasRegex := r.Header["X-Purge-Regex"]
+	var err error
+	switch {
+	case r.Method == "BAN":
+		err = prepareBan(r, body)
+	case hasRegex:
+		if hasTagHeaders(r) {
+			err = fmt.Errorf("purge by either X-Purge-Regex or cache tags, not both")
+		}
+	default:
+		err = prepareTagPurge(r, body)
+	}
+	if err != nil {
+		if *debug {
+			log.Printf("Error invalid request: %v\n", err)
+		}
+		purgesReceived.inc(r.Method, "invalid")
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if r.Method == "BAN" || !hasRegex {
+		// The criteria now travel in headers
+		body = nil
+	}
+
+	if purgeJobs != nil {
+		queuePurge(w, r, body)
+		return
+	}
+
+	// Retries stop once the purge timeout is reached
+	ctx, cancel := context.WithTimeout(r.Context(), state.settings.purgeTimeout)
+	defer cancel()
+
+	var results []backendResult
+	if state.settings.coalesceWindow > 0 {
+		results, err = purgeCoalescer.do(ctx, purgeKey(r, body), state.settings.coalesceWindow, func(ctx context.Context) []backendResult {
+			return fanOut(ctx, r, body, registry.backends(), state)
+		})
+		if err != nil {
+			// The client went away before the merged purge was sent
+			purgesReceived.inc(r.Method, "failed")
+			return
+		}
+	} else {
+		results = fanOut(ctx, r, body, registry.backends(), state)
+	}
+	report, status := newPurgeReport(results, state.settings.partialStatus, state.settings.failureStatus)
+	purgesReceived.inc(r.Method, report.Result)
+	writeReport(w, r, report, status)
+}
+
+// readBody reads the body of r, responding with 413 if it is longer than
+// limit or 400 if it can't be read
+func readBody(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, bool) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("request body is larger than %d bytes", limit), 413)
+			return nil, false
+		}
+		http.Error(w, http.StatusText(400), 400)
+		return nil, false
+	}
+	return body, true
+}
+
+// fanOut sends a copy of r with body to every backend at once, returning the
+// results in the order of privateIPs
+func fanOut(ctx context.Context, r *http.Request, body []byte, privateIPs []string, state *proxyState) []backendResult {
+	log.Printf("Sending %s to: %+v", r.Method, privateIPs)
 	// start gorountine for each server
-	responseChannel := make(chan int, len(privateIPs))
+	responseChannel := make(chan backendResult, len(privateIPs))
 	requesturl := fmt.Sprintf("%v", r.URL)
 
 	var wg sync.WaitGroup
 	wg.Add(len(privateIPs))
 
 	for _, ip := range privateIPs {
-		req, err := copyRequest(r)
+		req, err := copyRequest(ctx, r, body)
 		if err != nil {
 			wg.Add(-1)
-			if *debug {
-				log.Println("Failed to copy request.")
-			}
+			log.Printf("Failed to copy request for %s: %s\n", ip, err)
+			responseChannel <- backendResult{Backend: state.settings.deliveryAddr(ip), Error: err.Error()}
 		} else {
-			go forwardRequest(req, ip, *destport, *client, requesturl, responseChannel, &wg)
+			go forwardRequest(req, ip, state, requesturl, responseChannel, &wg)
 		}
 	}
 
 	wg.Wait()
+	close(responseChannel)
 
-	select {
-	case _, ok := <-responseChannel:
-		if ok {
-			// Response channel contains at least one error
-			http.Error(w, http.StatusText(500), 500)
-		} else {
-			// Channel has been closed
-			http.Error(w, http.StatusText(500), 500)
+	// Report backends in the order they were found
+	byBackend := map[string]backendResult{}
+	for result := range responseChannel {
+		backendLatency.observe(result.Latency, result.Backend)
+		if result.failed() {
+			backendErrors.inc(result.Backend)
 		}
-	default:
+		byBackend[result.Backend] = result
+	}
+	results := []backendResult{}
+	for _, ip := range privateIPs {
+		if result, ok := byBackend[state.settings.deliveryAddr(ip)]; ok {
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request, state *proxyState) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(405), 405)
 		return
 	}
+	found := registry.current()
+	status := struct {
+		Backends    []string                 `json:"backends"`
+		LastSuccess time.Time                `json:"last_success"`
+		LookupError string                   `json:"lookup_error,omitempty"`
+		Sources     []providers.SourceStatus `json:"sources"`
+		Queue       *queueStatus             `json:"queue,omitempty"`
+	}{
+		Backends:    found.Backends,
+		LastSuccess: found.Succeeded,
+		LookupError: found.Error,
+		Sources:     []providers.SourceStatus{},
+	}
+	if m, ok := state.service.(*providers.MultiProvider); ok {
+		status.Sources = m.Status()
+	}
+	if purgeJobs != nil {
+		queue := purgeJobs.status()
+		status.Queue = &queue
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
 }
 
-func copyRequest(src *http.Request) (*http.Request, error) {
-	req, err := http.NewRequest(src.Method, src.URL.String(), src.Body)
+func copyRequest(ctx context.Context, src *http.Request, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, src.Method, src.URL.String(), bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
@@ -196,31 +430,102 @@ func copyRequest(src *http.Request) (*http.Request, error) {
 	return req, nil
 }
 
-func forwardRequest(r *http.Request, ip string, destport int, client http.Client, requesturl string, responseChannel chan int, wg *sync.WaitGroup) {
+func forwardRequest(r *http.Request, ip string, state *proxyState, requesturl string, responseChannel chan backendResult, wg *sync.WaitGroup) {
 	defer wg.Done()
+	var session *cliSession
+	if state.settings.transport == "cli" {
+		session = newCLISession(ip, state)
+		defer session.Close()
+	}
+	responseChannel <- forward(r, ip, state, requesturl, session)
+}
+
+// forward sends a copied purge request to one backend, as a ban over
+// session when using the CLI transport
+func forward(r *http.Request, ip string, state *proxyState, requesturl string, session *cliSession) backendResult {
 	r.Host = r.Header.Get("Host")
 	r.RequestURI = ""
 
-	newURL, err := url.Parse(fmt.Sprintf("http://%v:%d%v", ip, destport, requesturl))
+	if session != nil {
+		return forwardBan(r, session)
+	}
+
+	result := backendResult{Backend: backendAddr(ip, state.settings.destport)}
+	newURL, err := url.Parse(fmt.Sprintf("http://%v%v", result.Backend, requesturl))
 	if err != nil {
 		log.Printf("Error parsing URL: %s\n", err)
 		if *debug {
-			log.Printf("For URL: %s\n", fmt.Sprintf("http://%v:%d%v", ip, destport, requesturl))
+			log.Printf("For URL: %s\n", fmt.Sprintf("http://%v%v", result.Backend, requesturl))
 		}
-		responseChannel <- 500
-		return
+		result.Error = err.Error()
+		return result
 	}
 	r.URL = newURL
-	response, err := client.Do(r)
-	if err != nil {
-		log.Printf("Error sending request: %s\n", err)
-		if *debug {
+
+	deliver(r.Context(), &state.settings.retry, &result, func(attempt int) (int, error) {
+		if attempt > 1 && r.GetBody != nil {
+			r.Body, _ = r.GetBody()
+		}
+		status, err := sendRequest(r, state.client, state.success)
+		if err != nil && *debug {
 			log.Printf("For URL: %s\n", r.URL)
 		}
-		responseChannel <- 500
-		return
+		return status, err
+	})
+	return result
+}
+
+// deliver makes attempts at sending a purge to one backend until send
+// succeeds or the retry policy gives up, recording the outcome in result
+func deliver(ctx context.Context, policy *retryPolicy, result *backendResult, send func(attempt int) (int, error)) {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		result.Attempts = attempt
+		status, err := send(attempt)
+		result.Status = status
+		if err == nil {
+			result.Error = ""
+			break
+		}
+		result.Error = err.Error()
+		log.Printf("Purge attempt %d of %d failed on %s: %s\n", attempt, policy.attempts, result.Backend, err)
+		if attempt >= policy.attempts || !policy.retryable(status, err) || !policy.wait(ctx, attempt) {
+			break
+		}
+	}
+	result.Latency = time.Since(start)
+}
+
+// sendRequest makes one attempt at a purge, returning the status code if
+// there was a response and an error if the purge failed
+func sendRequest(r *http.Request, client *http.Client, success *successCriteria) (int, error) {
+	response, err := client.Do(r)
+	if err != nil {
+		return 0, err
 	}
-	io.Copy(ioutil.Discard, response.Body)
 	defer response.Body.Close()
-	return
+	var body []byte
+	if success.body != nil {
+		body, _ = ioutil.ReadAll(io.LimitReader(response.Body, maxCheckedBody))
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	return response.StatusCode, success.check(r.Method, response.StatusCode, body)
+}
+
+// backendAddr returns the host:port to send a request to, backends that
+// already carry their own port keep it, otherwise destport is used
+func backendAddr(ip string, destport int) string {
+	if _, _, err := net.SplitHostPort(ip); err == nil {
+		return ip
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(destport))
+}
+
+// deliveryAddr returns the address purges for a backend are sent to, its
+// varnish CLI when --transport=cli is used
+func (s settings) deliveryAddr(ip string) string {
+	if s.transport == "cli" {
+		return cliAddr(ip, s.cliPort)
+	}
+	return backendAddr(ip, s.destport)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
@@ -8,9 +9,12 @@ import (
 	"net/url"
 	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/BashtonLtd/varnish-purge-proxy/providers"
 )
 
 func expect(t *testing.T, k string, a interface{}, b interface{}) {
@@ -19,21 +23,91 @@ func expect(t *testing.T, k string, a interface{}, b interface{}) {
 	}
 }
 
+// fixedService always returns the same backends
+type fixedService []string
+
+func (f fixedService) Auth() error { return nil }
+func (f fixedService) Backends(ctx context.Context) ([]providers.Backend, error) {
+	return toBackends(f), nil
+}
+
+// toBackends converts host[:port] strings to backends
+func toBackends(addresses []string) []providers.Backend {
+	backends := []providers.Backend{}
+	for _, a := range addresses {
+		host, strport, err := net.SplitHostPort(a)
+		if err != nil {
+			backends = append(backends, providers.Backend{Address: a})
+			continue
+		}
+		port, _ := strconv.Atoi(strport)
+		backends = append(backends, providers.Backend{Address: host, Port: port})
+	}
+	return backends
+}
+
+// useService makes purges go to the backends of service, with settings s
+// and defaults for the purge settings s leaves unset, replacing the backends
+// found by earlier tests
+func useService(t *testing.T, s settings, service providers.Service) *proxyState {
+	t.Helper()
+	if s.purgeTimeout == 0 {
+		s.purgeTimeout = 5 * time.Second
+	}
+	if s.retry.attempts == 0 {
+		s.retry.attempts = 1
+	}
+	if s.partialStatus == 0 {
+		s.partialStatus = 207
+	}
+	if s.failureStatus == 0 {
+		s.failureStatus = 500
+	}
+	state := &proxyState{settings: s, service: service, client: &http.Client{}, success: &successCriteria{}}
+	currentState.Store(state)
+	registry = newBackendRegistry()
+	registry.refresh(state)
+	return state
+}
+
+// useBackends makes purges go to addrs, see useService
+func useBackends(t *testing.T, s settings, addrs ...string) *proxyState {
+	t.Helper()
+	return useService(t, s, fixedService(addrs))
+}
+
 func TestForwardRequest(t *testing.T) {
+	var mu sync.Mutex
+	flaky := 0
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(200)
+		switch r.URL.Path {
+		case "/rejected":
+			w.WriteHeader(405)
+		case "/unavailable":
+			w.WriteHeader(503)
+		case "/flaky":
+			// Fails the first time it is requested
+			mu.Lock()
+			flaky++
+			if flaky == 1 {
+				w.WriteHeader(503)
+			}
+			mu.Unlock()
+		default:
+			w.WriteHeader(200)
+		}
 		fmt.Fprintln(w, "")
 	}))
 	defer server.Close()
 
 	u, err := url.Parse(server.URL)
 	if err != nil {
-		t.Fatalf(err.Error())
+		t.Fatal(err)
 	}
 	host, strport, _ := net.SplitHostPort(u.Host)
 	port, err := strconv.Atoi(strport)
 	if err != nil {
-		t.Fatalf(err.Error())
+		t.Fatal(err)
 	}
 
 	cases := map[string]struct {
@@ -41,39 +115,209 @@ func TestForwardRequest(t *testing.T) {
 		host     string
 		port     int
 		expected bool
+		attempts int
 	}{
-		"success":    {"/", host, port, false},
-		"brokenurl":  {"/%", host, port, true},
-		"noresponse": {"/", host, 1234, true},
+		"success":     {"/", host, port, false, 1},
+		"brokenurl":   {"/%", host, port, true, 0},
+		"noresponse":  {"/", host, 1234, true, 3},
+		"rejected":    {"/rejected", host, port, true, 1},
+		"unavailable": {"/unavailable", host, port, true, 3},
+		"flaky":       {"/flaky", host, port, false, 2},
 	}
+	success, _ := newSuccessCriteria(nil, "")
 
 	for k, tc := range cases {
 		// build request
 		request, err := http.NewRequest("GET", "http://127.0.0.1", nil)
 		if err != nil {
-			t.Fatalf(err.Error())
+			t.Fatal(err)
 		}
 		timeout := time.Duration(5 * time.Second)
-		client := http.Client{
-			Timeout: timeout,
+		state := &proxyState{
+			settings: settings{
+				destport: tc.port,
+				retry:    retryPolicy{attempts: 3, backoff: time.Millisecond, maxBackoff: time.Millisecond, statuses: []int{503}, errors: []string{"refused"}},
+			},
+			client: &http.Client{
+				Timeout: timeout,
+			},
+			success: success,
 		}
-		channel := make(chan int, 10)
+		channel := make(chan backendResult, 10)
 
 		var wg sync.WaitGroup
 		wg.Add(1)
-		forwardRequest(request, host, tc.port, client, tc.url, channel, &wg)
-		errored := false
+		forwardRequest(request, host, state, tc.url, channel, &wg)
+		result := <-channel
+		expect(t, k, result.failed(), tc.expected)
+		expect(t, k, result.Backend, backendAddr(host, tc.port))
+		expect(t, k, result.Attempts, tc.attempts)
+	}
+
+}
+
+func TestBackendAddr(t *testing.T) {
+	cases := map[string]struct {
+		ip       string
+		expected string
+	}{
+		"ip":       {"10.0.0.1", "10.0.0.1:80"},
+		"hostport": {"10.0.0.1:6081", "10.0.0.1:6081"},
+		"ipv6":     {"::1", "[::1]:80"},
+		"ipv6port": {"[::1]:6081", "[::1]:6081"},
+	}
+
+	for k, tc := range cases {
+		expect(t, k, backendAddr(tc.ip, 80), tc.expected)
+	}
+}
+
+func TestRequestHandlerBodyLimit(t *testing.T) {
+	useBackends(t, settings{})
+
+	req := httptest.NewRequest("PURGE", "/", strings.NewReader(strings.Repeat("x", maxPurgeBody+1)))
+	req.Header.Set("X-Purge-Regex", ".*")
+	w := httptest.NewRecorder()
+	requestHandler(w, req, loadState())
+	expect(t, "toolarge", w.Code, 413)
+}
+
+func TestShutdown(t *testing.T) {
+	received := make(chan bool, 1)
+	release := make(chan bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- true
+		<-release
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	cases := map[string]struct {
+		timeout time.Duration
+		release bool
+	}{
+		"drains":  {time.Second, true},
+		"bounded": {50 * time.Millisecond, false},
+	}
+
+	for k, tc := range cases {
+		useBackends(t, settings{shutdownTimeout: tc.timeout}, backendURL.Host)
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := newServer(loadState().settings)
+		go server.Serve(listener)
+
+		status := make(chan int, 1)
+		go func() {
+			req, _ := http.NewRequest("PURGE", "http://"+listener.Addr().String()+"/", nil)
+			req.Header.Set("X-Purge-Regex", ".*")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				status <- 0
+				return
+			}
+			resp.Body.Close()
+			status <- resp.StatusCode
+		}()
+		<-received
+
+		done := make(chan bool)
+		go func() {
+			shutdown(server, loadState())
+			close(done)
+		}()
+
+		if tc.release {
+			select {
+			case <-done:
+				t.Fatalf("%s: Shutdown finished before the purge", k)
+			case <-time.After(50 * time.Millisecond):
+			}
+			release <- true
+		}
+
 		select {
-		case _, ok := <-channel:
-			if ok {
-				errored = true
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: Shutdown did not finish", k)
+		}
+		if tc.release {
+			expect(t, k, <-status, 200)
+		} else {
+			release <- true
+		}
+	}
+}
+
+func TestRequestHandlerConcurrent(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	_, port, _ := net.SplitHostPort(backendURL.Host)
+
+	service := &changingService{}
+	service.set(backendURL.Host)
+	state := useService(t, settings{}, service)
+	handler := newServer(state.settings).Handler
+
+	// Each purge also asks for a lookup, maybe with a reload, and for the
+	// status pages, which race it in the background
+	lookups := make(chan int, 200)
+	reads := make(chan bool, 200)
+	var background sync.WaitGroup
+	background.Add(2)
+	go func() {
+		defer background.Done()
+		for i := range lookups {
+			if i%2 == 0 {
+				service.set(backendURL.Host, net.JoinHostPort("localhost", port))
 			} else {
-				errored = true
+				service.set(backendURL.Host)
+			}
+			if i%5 == 0 {
+				currentState.Store(&proxyState{settings: state.settings, service: service, client: state.client, success: state.success})
+			}
+			registry.refresh(loadState())
+		}
+	}()
+	go func() {
+		defer background.Done()
+		for range reads {
+			for _, path := range []string{"/status", "/metrics", "/readyz"} {
+				handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
 			}
-		default:
-			errored = false
 		}
-		expect(t, k, errored, tc.expected)
+	}()
+
+	var wg sync.WaitGroup
+	statuses := make(chan int, 200)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				lookups <- i*10 + j
+				reads <- true
+				req := httptest.NewRequest("PURGE", "/", nil)
+				req.Header.Set("X-Purge-Regex", ".*")
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				statuses <- w.Code
+			}
+		}(i)
 	}
+	wg.Wait()
+	close(lookups)
+	close(reads)
+	background.Wait()
+	close(statuses)
 
+	for status := range statuses {
+		expect(t, "status", status, 200)
+	}
 }